@@ -1,9 +1,12 @@
 package gorpc
 
 import (
+	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"reflect"
+	"strconv"
 	"strings"
 )
 
@@ -13,31 +16,221 @@ import (
 // statically typed command infrastructure which handles creation of these
 // requests, however this struct it being exported in case the caller wants to
 // construct raw requests for some reason.
+//
+// JSON-RPC 2.0 also allows the params to be an object keyed by parameter
+// name.  Such params are stored in NamedParams instead of Params.
 type Request struct {
-	Jsonrpc string            `json:"jsonrpc"`
-	Method  string            `json:"method"`
-	Params  []json.RawMessage `json:"params"`
-	ID      interface{}       `json:"id"`
+	Jsonrpc     string                     `json:"jsonrpc"`
+	Method      string                     `json:"method"`
+	Params      []json.RawMessage          `json:"params"`
+	NamedParams map[string]json.RawMessage `json:"-"`
+	ID          interface{}                `json:"id"`
+
+	// hasID records whether the decoded request had an id member at all,
+	// which tells a JSON-RPC 2.0 notification apart from "id":null.
+	hasID bool
+}
+
+// rawRequest is the wire format of a Request with the params and id left
+// undecoded so the params can be either an array or an object and a missing
+// id can be told apart from a null one.
+type rawRequest struct {
+	Jsonrpc string          `json:"jsonrpc"`
+	Method  string          `json:"method"`
+	Params  json.RawMessage `json:"params"`
+	ID      json.RawMessage `json:"id"`
+}
+
+// UnmarshalJSON decodes a request whose params are either an array (by
+// position) or an object (by name).
+func (r *Request) UnmarshalJSON(b []byte) error {
+	var raw rawRequest
+	if err := json.Unmarshal(b, &raw); err != nil {
+		return err
+	}
+	*r = Request{
+		Jsonrpc: raw.Jsonrpc,
+		Method:  raw.Method,
+		hasID:   raw.ID != nil,
+	}
+	if raw.ID != nil {
+		if err := json.Unmarshal(raw.ID, &r.ID); err != nil {
+			return err
+		}
+	}
+
+	params := bytes.TrimSpace(raw.Params)
+	switch {
+	case len(params) == 0 || bytes.Equal(params, []byte("null")):
+	case params[0] == '[':
+		return json.Unmarshal(params, &r.Params)
+	case params[0] == '{':
+		return json.Unmarshal(params, &r.NamedParams)
+	default:
+		return errors.New("params must be an array or an object")
+	}
+	return nil
+}
+
+// MarshalJSON encodes the request, writing NamedParams as an object when they
+// are set.
+func (r Request) MarshalJSON() ([]byte, error) {
+	raw := rawRequest{
+		Jsonrpc: r.Jsonrpc,
+		Method:  r.Method,
+	}
+	id, err := json.Marshal(r.ID)
+	if err != nil {
+		return nil, err
+	}
+	raw.ID = id
+	var params interface{} = r.Params
+	if r.NamedParams != nil {
+		params = r.NamedParams
+	}
+	marshalledParams, err := json.Marshal(params)
+	if err != nil {
+		return nil, err
+	}
+	raw.Params = marshalledParams
+	return json.Marshal(raw)
+}
+
+// IsNotification returns whether the request is a notification under the
+// rules of the JSON-RPC version it was sent with.  A JSON-RPC 2.0 notification
+// has no id member at all, "id":null is a valid id that must be answered.
+// JSON-RPC 1.0 notifications have their id set to null.  Notifications must
+// not be responded to.
+func (r *Request) IsNotification() bool {
+	if r.ID != nil {
+		return false
+	}
+	if r.Jsonrpc == RPCVersion2 {
+		return !r.hasID
+	}
+	return true
+}
+
+// validate checks the request has the members a JSON-RPC request object
+// requires: a supported jsonrpc version, if any, a method and an id that is a
+// string, a number or null.
+func (r *Request) validate() error {
+	switch r.Jsonrpc {
+	case "", RPCVersion1, RPCVersion2:
+	default:
+		return fmt.Errorf("unsupported jsonrpc version %q", r.Jsonrpc)
+	}
+	if r.Method == "" {
+		return errors.New("missing method")
+	}
+	switch r.ID.(type) {
+	case nil, string, float64:
+	default:
+		return errors.New("id must be a string, a number or null")
+	}
+	return nil
+}
+
+// unmarshalRequest decodes a request object received by the server and
+// checks it is a valid JSON-RPC request.
+func unmarshalRequest(b []byte, r *Request) error {
+	if err := json.Unmarshal(b, r); err != nil {
+		return err
+	}
+	return r.validate()
+}
+
+// Response is the general form of a JSON-RPC response.  The type of the
+// Result field varies from one command to the next, so it is implemented as
+// an interface.  The ID field has to be a pointer for Go to put a null in it
+// when empty.
+type Response struct {
+	Jsonrpc string          `json:"jsonrpc,omitempty"`
+	Result  json.RawMessage `json:"result"`
+	Error   *RPCError       `json:"error"`
+	ID      *interface{}    `json:"id"`
+}
+
+// response2 is the JSON-RPC 2.0 form of a Response, which carries either a
+// result or an error member but never both.
+type response2 struct {
+	Jsonrpc string          `json:"jsonrpc"`
+	Result  json.RawMessage `json:"result,omitempty"`
+	Error   *RPCError       `json:"error,omitempty"`
+	ID      *interface{}    `json:"id"`
+}
+
+// Supported JSON-RPC protocol versions.  Requests without a jsonrpc member
+// are treated as RPCVersion1.
+const (
+	RPCVersion1 = "1.0"
+	RPCVersion2 = "2.0"
+)
+
+// MarshalResponse marshals the passed rpc version, id, result, and RPCError to
+// a JSON-RPC response byte slice that is suitable for transmission to a
+// JSON-RPC client.  JSON-RPC 2.0 responses carry a "jsonrpc" member and either
+// a result or an error, any other version gets the legacy 1.0 envelope with
+// both members present.
+func MarshalResponse(rpcVersion string, id interface{}, result interface{}, rpcErr *RPCError) ([]byte, error) {
+	var marshalledResult []byte
+	if rpcErr == nil {
+		var err error
+		marshalledResult, err = json.Marshal(result)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if rpcVersion == RPCVersion2 {
+		return json.Marshal(&response2{
+			Jsonrpc: RPCVersion2,
+			Result:  marshalledResult,
+			Error:   rpcErr,
+			ID:      &id,
+		})
+	}
+	if marshalledResult == nil {
+		marshalledResult = []byte("null")
+	}
+	return json.Marshal(&Response{
+		Result: marshalledResult,
+		Error:  rpcErr,
+		ID:     &id,
+	})
 }
 
 // UnmarshalCmd unmarshals a JSON-RPC request into a suitable concrete command
 // so long as the method type contained within the marshalled request is
-// registered.
-
+// registered in the default registry.
 func UnmarshalCmd(r *Request) (interface{}, error) {
-	registerLock.Lock()
-	rtp, ok := methodToConcreteType[r.Method] // 从这个map中寻找,这里就是注册方法
-	info := methodToInfo[r.Method]
-	registerLock.Unlock()
+	return defaultRegistry.UnmarshalCmd(r)
+}
+
+// UnmarshalCmd unmarshals a JSON-RPC request into a suitable concrete command
+// so long as the method type contained within the marshalled request is
+// registered in the registry.
+func (r *Registry) UnmarshalCmd(req *Request) (interface{}, error) {
+	r.mtx.RLock()
+	rtp, ok := r.methodToConcreteType[req.Method] // 从这个map中寻找,这里就是注册方法
+	info := r.methodToInfo[req.Method]
+	r.mtx.RUnlock()
 	if !ok {
-		str := fmt.Sprintf("%q is not register", r.Method)
+		str := fmt.Sprintf("%q is not register", req.Method)
 		return nil, makeError(ErrUnregisteredMethod, str)
 	}
 	rt := rtp.Elem()
 	rvp := reflect.New(rt)
 	rv := rvp.Elem()
+	// 参数是一个对象的话，按照字段名解析
+	if req.NamedParams != nil {
+		if err := unmarshalNamedParams(req.NamedParams, &info, rv); err != nil {
+			return nil, err
+		}
+		return rvp.Interface(), nil
+	}
 	// 确保参数个数是正确的
-	numParams := len(r.Params)
+	numParams := len(req.Params)
 	if err := checkNumParams(numParams, &info); err != nil {
 		return nil, err
 	}
@@ -46,7 +239,7 @@ func UnmarshalCmd(r *Request) (interface{}, error) {
 		rvf := rv.Field(i)
 		// Unmarshal参数到结构体字段
 		concreteVal := rvf.Addr().Interface()
-		if err := json.Unmarshal(r.Params[i], &concreteVal); err != nil { // 参数和命令字段的顺序也应该是一一对应的
+		if err := json.Unmarshal(req.Params[i], &concreteVal); err != nil { // 参数和命令字段的顺序也应该是一一对应的
 			// The most common error is the wrong type, so
 			// explicitly detect that error and make it nicer.
 			fieldName := strings.ToLower(rt.Field(i).Name)
@@ -54,13 +247,25 @@ func UnmarshalCmd(r *Request) (interface{}, error) {
 				str := fmt.Sprintf("parameter #%d '%s' must "+
 					"be type %v (got %v)", i+1, fieldName,
 					jerr.Type, jerr.Value)
-				return nil, makeError(ErrInvalidType, str)
+				return nil, makeParamError(ErrInvalidType, str,
+					&ParamErrorData{
+						Index:    i + 1,
+						Name:     fieldName,
+						Expected: jerr.Type.String(),
+						Got:      jerr.Value,
+						Rule:     "type",
+					})
 			}
 
 			// Fallback to showing the underlying error.
 			str := fmt.Sprintf("parameter #%d '%s' failed to "+
 				"unmarshal: %v", i+1, fieldName, err)
-			return nil, makeError(ErrInvalidType, str)
+			return nil, makeParamError(ErrInvalidType, str,
+				&ParamErrorData{
+					Index: i + 1,
+					Name:  fieldName,
+					Rule:  "type",
+				})
 		}
 	}
 	// When there are less supplied parameters than the total number of
@@ -73,6 +278,105 @@ func UnmarshalCmd(r *Request) (interface{}, error) {
 	return rvp.Interface(), nil
 }
 
+// unmarshalNamedParams unmarshals params keyed by name into the fields of the
+// passed struct value.  A key matches the name in the `json` tag of a field,
+// or the field name itself, preferring an exact match and falling back to a
+// case-insensitive one.  Keys that do not match any field are rejected, all
+// required fields must be present and missing optional fields are populated
+// with their default value.
+func unmarshalNamedParams(params map[string]json.RawMessage, info *methodInfo, rv reflect.Value) error {
+	rt := rv.Type()
+	provided := make(map[int]bool, len(params))
+	for key, param := range params {
+		i, ok := fieldByParamName(rt, key)
+		if !ok {
+			str := fmt.Sprintf("unknown parameter '%s'", key)
+			return makeParamError(ErrUnknownParam, str,
+				&ParamErrorData{Name: key, Rule: "unknown"})
+		}
+		if provided[i] {
+			name := paramName(rt.Field(i))
+			str := fmt.Sprintf("parameter '%s' specified more than "+
+				"once", name)
+			return makeParamError(ErrDuplicateParam, str,
+				&ParamErrorData{Name: name, Rule: "duplicate"})
+		}
+		provided[i] = true
+
+		concreteVal := rv.Field(i).Addr().Interface()
+		if err := json.Unmarshal(param, &concreteVal); err != nil {
+			name := paramName(rt.Field(i))
+			if jerr, ok := err.(*json.UnmarshalTypeError); ok {
+				str := fmt.Sprintf("parameter '%s' must be type "+
+					"%v (got %v)", name, jerr.Type, jerr.Value)
+				return makeParamError(ErrInvalidType, str,
+					&ParamErrorData{
+						Name:     name,
+						Expected: jerr.Type.String(),
+						Got:      jerr.Value,
+						Rule:     "type",
+					})
+			}
+
+			// Fallback to showing the underlying error.
+			str := fmt.Sprintf("parameter '%s' failed to unmarshal: "+
+				"%v", name, err)
+			return makeParamError(ErrInvalidType, str,
+				&ParamErrorData{Name: name, Rule: "type"})
+		}
+	}
+
+	for i := 0; i < info.maxParams; i++ {
+		if provided[i] {
+			continue
+		}
+		if i < info.numReqParams {
+			name := paramName(rt.Field(i))
+			str := fmt.Sprintf("missing required parameter '%s'",
+				name)
+			return makeParamError(ErrMissingParam, str,
+				&ParamErrorData{Name: name, Rule: "required"})
+		}
+		if defaultVal, ok := info.defaults[i]; ok {
+			rv.Field(i).Set(defaultVal)
+		}
+	}
+	return nil
+}
+
+// paramName returns the name a struct field is addressed by in named params,
+// which is the name of its `json` tag if it has one and the field name
+// otherwise.
+func paramName(rtf reflect.StructField) string {
+	if tag := rtf.Tag.Get("json"); tag != "" {
+		if name := strings.Split(tag, ",")[0]; name != "" && name != "-" {
+			return name
+		}
+	}
+	return rtf.Name
+}
+
+// fieldByParamName returns the index of the struct field the passed named
+// param key refers to.  Fields tagged `json:"-"` can not be set by name.
+func fieldByParamName(rt reflect.Type, key string) (int, bool) {
+	numFields := rt.NumField()
+	for i := 0; i < numFields; i++ {
+		rtf := rt.Field(i)
+		if rtf.Tag.Get("json") != "-" && paramName(rtf) == key {
+			return i, true
+		}
+	}
+	for i := 0; i < numFields; i++ {
+		rtf := rt.Field(i)
+		if rtf.Tag.Get("json") != "-" &&
+			strings.EqualFold(paramName(rtf), key) {
+
+			return i, true
+		}
+	}
+	return 0, false
+}
+
 // populateDefaults populates default values into any remaining optional struct
 // fields that did not have parameters explicitly provided.  The caller should
 // have previously checked that the number of parameters being passed is at
@@ -93,14 +397,99 @@ func populateDefaults(numParams int, info *methodInfo, rv reflect.Value) {
 
 func checkNumParams(numParams int, info *methodInfo) error {
 	if numParams < info.numReqParams || numParams > info.maxParams {
+		param := &ParamErrorData{
+			Got:  strconv.Itoa(numParams),
+			Rule: "count",
+		}
 		if info.numReqParams == info.maxParams {
+			param.Expected = strconv.Itoa(info.numReqParams)
 			str := fmt.Sprintf("wrong numnber of params (expacted %d ,receive %d)", info.numReqParams, numParams)
-			return makeError(ErrNumParams, str)
+			return makeParamError(ErrNumParams, str, param)
 		}
+		param.Expected = fmt.Sprintf("%d-%d", info.numReqParams,
+			info.maxParams)
 		str := fmt.Sprintf("wrong number of params (expected "+
 			"between %d and %d, received %d)", info.numReqParams,
 			info.maxParams, numParams)
-		return makeError(ErrNumParams, str)
+		return makeParamError(ErrNumParams, str, param)
 	}
 	return nil
 }
+
+// NewRequest returns a new JSON-RPC 1.0 request object given the provided id,
+// method, and parameters.  The parameters are marshalled into a
+// json.RawMessage for the Params field of the returned request object.
+func NewRequest(id interface{}, method string, params []interface{}) (*Request, error) {
+	rawParams := make([]json.RawMessage, 0, len(params))
+	for _, param := range params {
+		marshalledParam, err := json.Marshal(param)
+		if err != nil {
+			return nil, err
+		}
+		rawMessage := json.RawMessage(marshalledParam)
+		rawParams = append(rawParams, rawMessage)
+	}
+
+	return &Request{
+		Jsonrpc: RPCVersion1,
+		ID:      id,
+		Method:  method,
+		Params:  rawParams,
+	}, nil
+}
+
+// MarshalCmd marshals the passed command to a JSON-RPC request byte slice that
+// is suitable for transmission to an RPC server.  The provided command type
+// must be a registered type.  Notifications are marshalled with a nil id.
+func MarshalCmd(id interface{}, cmd interface{}) ([]byte, error) {
+	return defaultRegistry.MarshalCmd(id, cmd)
+}
+
+// MarshalCmd marshals the passed command, whose type must be registered in the
+// registry, to a JSON-RPC request byte slice.
+func (r *Registry) MarshalCmd(id interface{}, cmd interface{}) ([]byte, error) {
+	// Look up the cmd type and error out if not registered.
+	rt := reflect.TypeOf(cmd)
+	r.mtx.RLock()
+	method, ok := r.concreteTypeToMethod[rt]
+	r.mtx.RUnlock()
+	if !ok {
+		str := fmt.Sprintf("type %v is not registered", rt)
+		return nil, makeError(ErrUnregisteredMethod, str)
+	}
+
+	// The provided command must not be nil.
+	rv := reflect.ValueOf(cmd)
+	if rv.IsNil() {
+		str := "the specified command is nil"
+		return nil, makeError(ErrInvalidType, str)
+	}
+
+	// Create a slice of interface values in the order of the struct fields
+	// while respecting pointer fields as optional params and only adding
+	// them if they are non-nil.
+	params := makeParams(rt.Elem(), rv.Elem())
+
+	// Generate and marshal the final JSON-RPC request.
+	rawCmd, err := NewRequest(id, method, params)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(rawCmd)
+}
+
+// makeParams creates a slice of interface values for the given struct.
+func makeParams(rt reflect.Type, rv reflect.Value) []interface{} {
+	numFields := rt.NumField()
+	params := make([]interface{}, 0, numFields)
+	for i := 0; i < numFields; i++ {
+		rtf := rt.Field(i)
+		rvf := rv.Field(i)
+		if rtf.Type.Kind() == reflect.Ptr && rvf.IsNil() {
+			break
+		}
+		params = append(params, rvf.Interface())
+	}
+
+	return params
+}
@@ -58,6 +58,30 @@ const (
 	// match the requirements of the associated command.
 	ErrNumParams
 
+	// ErrUnknownParam indicates a named parameter was supplied that does
+	// not match any field of the associated command.
+	ErrUnknownParam
+
+	// ErrMissingParam indicates a required named parameter was not
+	// supplied.
+	ErrMissingParam
+
+	// ErrDuplicateErrorCode indicates an application error code, its name
+	// or a namespace of error codes is already registered.
+	ErrDuplicateErrorCode
+
+	// ErrInvalidErrorCode indicates an application error code lies outside
+	// the range of its namespace or the namespace itself is invalid.
+	ErrInvalidErrorCode
+
+	// ErrInvalidHandler indicates a typed handler passed to RegisterFunc
+	// does not have the form func(context.Context, *Cmd) (Result, error).
+	ErrInvalidHandler
+
+	// ErrDuplicateParam indicates a named parameter was supplied more than
+	// once.
+	ErrDuplicateParam
+
 	// numErrorCodes is the maximum error code number used in tests.
 	numErrorCodes
 )
@@ -76,6 +100,12 @@ var errorCodeStrings = map[ErrorCode]string{
 	ErrUnregisteredMethod:   "ErrUnregisteredMethod",
 	ErrMissingDescription:   "ErrMissingDescription",
 	ErrNumParams:            "ErrNumParams",
+	ErrUnknownParam:         "ErrUnknownParam",
+	ErrMissingParam:         "ErrMissingParam",
+	ErrDuplicateErrorCode:   "ErrDuplicateErrorCode",
+	ErrInvalidErrorCode:     "ErrInvalidErrorCode",
+	ErrInvalidHandler:       "ErrInvalidHandler",
+	ErrDuplicateParam:       "ErrDuplicateParam",
 }
 
 // String returns the ErrorCode as a human-readable name.
@@ -94,6 +124,10 @@ func (e ErrorCode) String() string {
 type Error struct {
 	ErrorCode   ErrorCode // Describes the kind of error
 	Description string    // Human readable description of the issue
+
+	// Param describes the offending parameter of errors about the params
+	// of a request.  It is sent to the client as the data of the error.
+	Param *ParamErrorData
 }
 
 // Error satisfies the error interface and prints human-readable errors.
@@ -105,3 +139,8 @@ func (e Error) Error() string {
 func makeError(c ErrorCode, desc string) Error {
 	return Error{ErrorCode: c, Description: desc}
 }
+
+// makeParamError creates an Error about the passed parameter.
+func makeParamError(c ErrorCode, desc string, param *ParamErrorData) Error {
+	return Error{ErrorCode: c, Description: desc, Param: param}
+}
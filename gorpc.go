@@ -1,163 +1,944 @@
 package gorpc
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/btcsuite/btcd/btcjson"
 	"github.com/gorilla/websocket"
 	"io"
 	"io/ioutil"
-	"log"
 	"net"
 	"net/http"
 	"net/http/httputil"
 	"strconv"
 	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// defaultRPCListen is the address the RPC server listens on when neither
+// Listeners nor ListenAddrs are provided in the config.
+const defaultRPCListen = ":8009"
+
+// defaultShutdownTimeout is how long Stop waits for in-flight requests when
+// the config does not specify a ShutdownTimeout.
+const defaultShutdownTimeout = 5 * time.Second
+
+const (
+	// defaultMaxRequestBodySize is the maximum size of a request body, or
+	// of a websocket message, when MaxRequestBodySize is not set.
+	defaultMaxRequestBodySize = 1 << 20
+
+	// defaultReadHeaderTimeout and defaultIdleTimeout are used when the
+	// respective timeouts are not set in the config.
+	defaultReadHeaderTimeout = 10 * time.Second
+	defaultIdleTimeout       = 2 * time.Minute
+
+	// defaultHijackedWriteTimeout is the time allowed to write the reply
+	// to a hijacked connection when WriteTimeout is not set.
+	defaultHijackedWriteTimeout = 30 * time.Second
 )
 
 type RpcServerConfig struct {
+	// Listeners defines a slice of listeners for which the RPC server will
+	// take ownership of and accept connections.  Since the caller is
+	// responsible for creating these, any listener type can be used.
+	Listeners []net.Listener
+
+	// DisableListen creates the server without any listeners, for when it
+	// is only mounted in another HTTP server through ServeHTTP and
+	// WebsocketHandler.  Start can not be used in that case.
+	DisableListen bool
+
+	// ListenAddrs defines the addresses the RPC server will listen on in
+	// addition to Listeners.  Each entry must be of the form host:port,
+	// for example "127.0.0.1:8009", "[::1]:8009" or ":8009".  A port of 0
+	// picks an ephemeral port which can be discovered through Addrs.
+	ListenAddrs []string
+
+	// HTTPKeepAlive writes replies through the http.ResponseWriter and
+	// keeps the connection open for further (also pipelined) requests
+	// instead of hijacking it and closing it after every reply.  Handlers
+	// are still signalled when the client disconnects.  Connections that
+	// can not be hijacked, such as HTTP/2 ones of a server the RPC server
+	// is mounted in, are always kept alive.
+	HTTPKeepAlive bool
+
+	// MaxConcurrentBatch is the maximum number of requests of a single
+	// batch that are executed concurrently.  Values below 2 execute the
+	// batch sequentially.
+	MaxConcurrentBatch int
+
+	// ShutdownTimeout is the maximum time Stop waits for in-flight
+	// requests to finish before signalling their handlers to abort.
+	ShutdownTimeout time.Duration
+
+	// MaxRequestBodySize is the maximum size in bytes of a request body
+	// and of a websocket message.  Larger HTTP requests are rejected with
+	// 413 Request Entity Too Large, larger websocket messages close the
+	// connection.  It defaults to 1 MiB.
+	MaxRequestBodySize int64
+
+	// ReadHeaderTimeout, ReadTimeout, WriteTimeout and IdleTimeout are
+	// passed on to the http.Server.  ReadHeaderTimeout defaults to 10
+	// seconds and IdleTimeout to 2 minutes, the others are disabled by
+	// default since they also bound the time a handler may take in
+	// HTTPKeepAlive mode.  WriteTimeout additionally limits writing the
+	// reply to a hijacked connection, 30 seconds when not set.
+	ReadHeaderTimeout time.Duration
+	ReadTimeout       time.Duration
+	WriteTimeout      time.Duration
+	IdleTimeout       time.Duration
+
+	// EnableTLS serves the RPC endpoint over TLS using RPCCert and
+	// RPCKey.  When neither file exists a self-signed pair is generated.
+	EnableTLS bool
+	RPCCert   string
+	RPCKey    string
+
+	// RPCClientCAs is an optional PEM bundle of CAs.  When set, clients
+	// must present a certificate signed by one of them.
+	RPCClientCAs string
+
+	// TLSReloadInterval is how often the certificate files are checked
+	// for changes.  They are also reloaded when the process receives
+	// SIGHUP.
+	TLSReloadInterval time.Duration
+
+	// RPCUser and RPCPass are the credentials of the admin user, which
+	// may call every method.  RPCLimitUser and RPCLimitPass are the
+	// credentials of the limited user, which may only call the methods in
+	// RPCLimitedMethods.  Clients authenticate with HTTP Basic
+	// authentication; no authentication is required when neither user is
+	// configured.
+	RPCUser           string
+	RPCPass           string
+	RPCLimitUser      string
+	RPCLimitPass      string
+	RPCLimitedMethods []string
+
+	// Authenticator replaces the HTTP Basic authentication above with a
+	// custom scheme that maps requests to principals.
+	Authenticator Authenticator
+
+	// RPCRateLimit is the number of requests per second each client may
+	// send, with bursts of up to RPCRateBurst requests.  Authenticated
+	// clients are limited by their name, all others by their IP address.
+	// Every HTTP request, including a whole batch, and every websocket
+	// message counts as one request.  Zero disables rate limiting.
+	RPCRateLimit float64
+	RPCRateBurst int
+
+	// RPCMaxConcurrentReqs is the maximum number of handlers that may run
+	// concurrently across all clients.  Zero means no limit.
+	RPCMaxConcurrentReqs int
+
+	// WebsocketMaxConcurrentReqs is the maximum number of requests of a
+	// single websocket client that are handled concurrently.  Further
+	// messages are not read until one of them finished.  It defaults to 20.
+	WebsocketMaxConcurrentReqs int
+
+	// StrictRegistry makes Start fail when a registered command has no
+	// handler or a handler has no registered command, instead of only
+	// logging the inconsistencies.  Notifications and commands marked with
+	// AddUnimplemented don't need a handler.
+	StrictRegistry bool
+
+	// Registry holds the commands and handlers the server serves.  When
+	// nil the default registry, which the package-level Register functions
+	// add to, is used.
+	Registry *Registry
+
+	// OnPanic, when set, is called with the details of every panic
+	// recovered from a handler, for example to forward them to an error
+	// reporting system.  The client receives ErrRPCInternal along with the
+	// incident ID only.
+	OnPanic func(*PanicInfo)
+
+	// HandlerTimeout is the maximum time a handler may run for methods
+	// registered without WithTimeout.  Once it expires the context of the
+	// handler is cancelled and the client receives ErrRPCTimeout.  Zero
+	// means no limit.
+	HandlerTimeout time.Duration
+
 	RPCQuirks bool
 }
 type RpcServer struct {
-	started     int32
-	Config      *RpcServerConfig
+	started    int32
+	shutdown   int32
+	Config     *RpcServerConfig
+	listeners  []net.Listener
+	httpServer *http.Server
+	quit       chan struct{}
+	registry   *Registry
+
+	authRequired bool
+	authsha      [sha256.Size]byte
+	limitauthsha [sha256.Size]byte
+	rpcLimited   map[string]struct{}
+
+	// rateLimiter and handlerSem are nil when the respective limit is
+	// disabled.  limitLock protects methodActive, the number of running
+	// handlers of the methods with a concurrency cap.
+	rateLimiter  *rateLimiter
+	handlerSem   chan struct{}
+	limitLock    sync.Mutex
+	methodActive map[string]int
+
+	// timeouts is the number of handlers that exceeded their timeout.  It
+	// must be accessed atomically.
+	timeouts uint64
+
 	statusLock  sync.RWMutex
 	statusLines map[int]string
+
+	// activeLock protects activeReqs and orders request tracking with
+	// the shutdown flag so wg is never added to once Stop waits on it.
+	activeLock sync.Mutex
+	activeReqs map[*activeRequest]struct{}
+	wsClients  map[*WsClient]struct{}
+	wg         sync.WaitGroup
+
+	// ntfnLock protects the websocket notification subscriptions.
+	ntfnLock      sync.Mutex
+	subscriptions map[string]map[*WsClient]struct{}
+}
+
+// activeRequest tracks a request whose handler may currently be running so
+// Stop can wait for it and signal it to abort once the deadline passed.
+type activeRequest struct {
+	id         interface{}
+	method     string
+	remoteAddr string
+	started    time.Time
+
+	// ctx is the context the handlers of the request are run with.  It
+	// carries the RequestInfo of the connection.
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// close signals the handler of the request to abort.  It is safe to call
+// multiple times.
+func (r *activeRequest) close() {
+	r.cancel()
 }
 
+// AbortedRequest describes a request whose handler was still running when
+// the shutdown deadline passed during Stop.
+type AbortedRequest struct {
+	ID         interface{}
+	Method     string
+	RemoteAddr string
+	Duration   time.Duration
+}
+
+// NewRpcServer returns a new instance of the RpcServer struct.  All addresses
+// in the config are bound before returning so the caller learns about address
+// errors up front and can query the bound addresses with Addrs.
 func NewRpcServer(config *RpcServerConfig) (*RpcServer, error) {
+	listeners, err := setupRPCListeners(config)
+	if err != nil {
+		return nil, err
+	}
+	registry := config.Registry
+	if registry == nil {
+		registry = defaultRegistry
+	}
 	rs := &RpcServer{
 		Config:      config,
+		listeners:   listeners,
+		quit:        make(chan struct{}),
+		registry:    registry,
 		statusLines: make(map[int]string),
+		activeReqs:  make(map[*activeRequest]struct{}),
+		wsClients:   make(map[*WsClient]struct{}),
+
+		subscriptions: make(map[string]map[*WsClient]struct{}),
+	}
+
+	rs.setupAuth()
+	rs.setupLimits()
+
+	if config.EnableTLS {
+		if err := rs.setupTLS(); err != nil {
+			closeListeners(listeners)
+			return nil, err
+		}
+	}
+
+	rpcServeMux := http.NewServeMux()
+	rpcServeMux.Handle("/", rs)
+	rpcServeMux.HandleFunc("/ws", rs.WebsocketHandler)
+	readHeaderTimeout := config.ReadHeaderTimeout
+	if readHeaderTimeout <= 0 {
+		readHeaderTimeout = defaultReadHeaderTimeout
+	}
+	idleTimeout := config.IdleTimeout
+	if idleTimeout <= 0 {
+		idleTimeout = defaultIdleTimeout
 	}
+	rs.httpServer = &http.Server{
+		Handler:           rpcServeMux,
+		ReadHeaderTimeout: readHeaderTimeout,
+		ReadTimeout:       config.ReadTimeout,
+		WriteTimeout:      config.WriteTimeout,
+		IdleTimeout:       idleTimeout,
+	}
+	registry.addServer(rs)
 	return rs, nil
 }
-var upgrader = websocket.Upgrader{}
-func (rs *RpcServer) Start() {
-	rpcServeMux := http.NewServeMux()
 
-	rpcServeMux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Connection", "close")
-		w.Header().Set("Connect-Type", "application/json")
-		r.Close = true
-		// Read and respond to the request.
-		rs.jsonRPCRead(w, r)
-	})
+// setupRPCListeners returns the listeners the RPC server should accept
+// connections on.  It combines the caller provided listeners with new ones
+// bound to every entry of ListenAddrs, falling back to defaultRPCListen when
+// nothing was configured.  Any listeners created here are closed again if one
+// of the addresses can not be bound.
+func setupRPCListeners(config *RpcServerConfig) ([]net.Listener, error) {
+	if config.DisableListen {
+		return nil, nil
+	}
+	addrs := config.ListenAddrs
+	if len(config.Listeners) == 0 && len(addrs) == 0 {
+		addrs = []string{defaultRPCListen}
+	}
+
+	listeners := make([]net.Listener, 0, len(config.Listeners)+len(addrs))
+	listeners = append(listeners, config.Listeners...)
+	created := make([]net.Listener, 0, len(addrs))
+	for _, addr := range addrs {
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			closeListeners(created)
+			return nil, fmt.Errorf("invalid listen address %q: %v",
+				addr, err)
+		}
+		listener, err := net.Listen("tcp", addr)
+		if err != nil {
+			closeListeners(created)
+			return nil, fmt.Errorf("unable to listen on %s: %v", addr,
+				err)
+		}
+		created = append(created, listener)
+	}
+	return append(listeners, created...), nil
+}
 
-	httpServer := http.Server{
-		Handler: rpcServeMux,
+// setupTLS loads (or generates) the configured certificates, wraps every
+// listener with TLS and starts watching the files for changes.
+func (rs *RpcServer) setupTLS() error {
+	certFile := rs.Config.RPCCert
+	if certFile == "" {
+		certFile = defaultRPCCertFile
 	}
-	listen, err := net.Listen("tcp", ":8009")
+	keyFile := rs.Config.RPCKey
+	if keyFile == "" {
+		keyFile = defaultRPCKeyFile
+	}
+	reloader, err := newCertReloader(certFile, keyFile,
+		rs.Config.RPCClientCAs)
 	if err != nil {
-		log.Panicf("net listen error:%v", err)
+		return fmt.Errorf("unable to load TLS certificates: %v", err)
+	}
+
+	tlsConfig := reloader.tlsConfig()
+	for i, listener := range rs.listeners {
+		rs.listeners[i] = tls.NewListener(listener, tlsConfig)
 	}
-	rlog.Infof("rpc server listen :%v", listen.Addr())
-	httpServer.Serve(listen)
 
+	interval := rs.Config.TLSReloadInterval
+	if interval <= 0 {
+		interval = defaultTLSReloadInterval
+	}
+	go reloader.watch(interval, rs.quit)
+	return nil
 }
-func (rs *RpcServer) jsonRPCRead(w http.ResponseWriter, r *http.Request) {
-	// 打印出请求信息
-	byteReq, err := httputil.DumpRequest(r, true)
-	if err != nil {
-		fmt.Println(err)
+
+// closeListeners closes every listener in the passed slice, ignoring errors.
+func closeListeners(listeners []net.Listener) {
+	for _, listener := range listeners {
+		listener.Close()
 	}
-	rlog.Infof("receive request:%v", string(byteReq))
-	// 读取body信息
-	body, err := ioutil.ReadAll(r.Body)
-	r.Body.Close()
-	if err != nil {
-		errCode := http.StatusBadRequest
-		http.Error(w, fmt.Sprintf("%d error reading json message:%v", errCode, err), errCode)
+}
+
+// Addrs returns the addresses the RPC server is bound to.  Unlike the
+// configured ListenAddrs these contain the actual port for ":0" addresses.
+func (rs *RpcServer) Addrs() []net.Addr {
+	addrs := make([]net.Addr, 0, len(rs.listeners))
+	for _, listener := range rs.listeners {
+		addrs = append(addrs, listener.Addr())
+	}
+	return addrs
+}
+
+var upgrader = websocket.Upgrader{}
+
+// Start serves JSON-RPC requests on every listener concurrently.  It is a
+// convenience wrapper that serves ServeHTTP on "/" and WebsocketHandler on
+// "/ws".  It blocks until all of them stopped serving, either because of an
+// error or because Stop was called, and returns the first error encountered.
+// Commands lacking a handler and handlers lacking a command are reported
+// first, see StrictRegistry.  A stopped server can not be started again.
+func (rs *RpcServer) Start() error {
+	if len(rs.listeners) == 0 {
+		return errors.New("rpc server has no listeners")
+	}
+	if atomic.LoadInt32(&rs.shutdown) != 0 {
+		return errors.New("rpc server is stopped")
+	}
+	if err := rs.registry.validateHandlers(); err != nil {
+		if rs.Config.StrictRegistry {
+			return err
+		}
+		rlog.Warnf("%v", err)
+	}
+	if !atomic.CompareAndSwapInt32(&rs.started, 0, 1) {
+		return errors.New("rpc server is already started")
+	}
+
+	errChan := make(chan error, len(rs.listeners))
+	for _, listener := range rs.listeners {
+		go func(listener net.Listener) {
+			rlog.Infof("rpc server listen :%v", listener.Addr())
+			errChan <- rs.httpServer.Serve(listener)
+			rlog.Tracef("RPC listener done for %s", listener.Addr())
+		}(listener)
+	}
+
+	var firstErr error
+	for range rs.listeners {
+		err := <-errChan
+		if err != nil && err != http.ErrServerClosed && firstErr == nil {
+			firstErr = err
+		}
 	}
-	//获得底层的 TCP 连接，这样才能转发数据，
-	// 所以下面会有 Hijacker 类型转换和 Hijack() 调用，
-	// 它们最终的目的是拿到客户端的 TCP 连接（net.TCPConn）
-	hj, ok := w.(http.Hijacker)
-	if !ok {
-		errMsg := "webserver does not support hijacking"
-		rlog.Error(errMsg)
-		errCode := http.StatusInternalServerError
-		http.Error(w, strconv.Itoa(errCode)+" "+errMsg, errCode)
+	return firstErr
+}
+
+// Stop gracefully shuts down the RPC server.  It closes all listeners so no
+// new requests are accepted and waits up to ShutdownTimeout for in-flight
+// requests to finish.  Handlers still running after the deadline have their
+// closeChan signalled and are returned as aborted requests.  Websocket
+// clients are disconnected once the in-flight requests are done.
+func (rs *RpcServer) Stop() ([]AbortedRequest, error) {
+	rs.activeLock.Lock()
+	if !atomic.CompareAndSwapInt32(&rs.shutdown, 0, 1) {
+		rs.activeLock.Unlock()
+		return nil, errors.New("rpc server is already in the process " +
+			"of shutting down")
+	}
+	rs.activeLock.Unlock()
+	rlog.Infof("RPC server shutting down")
+	close(rs.quit)
+	rs.registry.removeServer(rs)
+
+	timeout := rs.Config.ShutdownTimeout
+	if timeout <= 0 {
+		timeout = defaultShutdownTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	// Shutdown only closes the listeners it is serving, so close them
+	// explicitly as well in case Start was never called.
+	err := rs.httpServer.Shutdown(ctx)
+	closeListeners(rs.listeners)
+	if err != nil && err != context.DeadlineExceeded {
+		return nil, err
+	}
+
+	done := make(chan struct{})
+	go func() {
+		rs.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		rs.disconnectWebsocketClients()
+		rlog.Infof("RPC server shutdown complete")
+		return nil, nil
+	case <-ctx.Done():
+	}
+
+	aborted := rs.abortActiveRequests()
+	rs.disconnectWebsocketClients()
+	rlog.Warnf("RPC server shutdown timed out, aborted %d in-flight "+
+		"requests", len(aborted))
+	return aborted, nil
+}
+
+// trackRequest registers a new in-flight request from the connection
+// described by the passed RequestInfo.  It returns nil when the server is
+// shutting down, in which case the request must be rejected.
+func (rs *RpcServer) trackRequest(info *RequestInfo) *activeRequest {
+	rs.activeLock.Lock()
+	defer rs.activeLock.Unlock()
+	if atomic.LoadInt32(&rs.shutdown) != 0 {
+		return nil
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	req := &activeRequest{
+		remoteAddr: info.RemoteAddr,
+		started:    time.Now(),
+		ctx:        withRequestInfo(ctx, info),
+		cancel:     cancel,
+	}
+	rs.activeReqs[req] = struct{}{}
+	rs.wg.Add(1)
+	return req
+}
+
+// setRequestInfo records the id and method of a tracked request once the
+// request body has been parsed.
+func (rs *RpcServer) setRequestInfo(req *activeRequest, id interface{}, method string) {
+	rs.activeLock.Lock()
+	req.id = id
+	req.method = method
+	rs.activeLock.Unlock()
+}
+
+// untrackRequest removes a finished request from the in-flight set.
+func (rs *RpcServer) untrackRequest(req *activeRequest) {
+	rs.activeLock.Lock()
+	delete(rs.activeReqs, req)
+	rs.activeLock.Unlock()
+	req.cancel()
+	rs.wg.Done()
+}
+
+// abortActiveRequests signals every in-flight request to abort and returns a
+// summary of them.
+func (rs *RpcServer) abortActiveRequests() []AbortedRequest {
+	rs.activeLock.Lock()
+	defer rs.activeLock.Unlock()
+	aborted := make([]AbortedRequest, 0, len(rs.activeReqs))
+	for req := range rs.activeReqs {
+		req.close()
+		aborted = append(aborted, AbortedRequest{
+			ID:         req.id,
+			Method:     req.method,
+			RemoteAddr: req.remoteAddr,
+			Duration:   time.Since(req.started),
+		})
+	}
+	return aborted
+}
+
+// hijacks returns whether the reply to a request is written to the hijacked
+// connection of w, which is closed afterwards.  That is the case unless
+// HTTPKeepAlive is set or the connection can not be hijacked.
+func (rs *RpcServer) hijacks(w http.ResponseWriter) bool {
+	_, ok := w.(http.Hijacker)
+	return ok && !rs.Config.HTTPKeepAlive
+}
+
+// ServeHTTP implements http.Handler for the JSON-RPC HTTP POST endpoint, so
+// the server can be mounted in an existing HTTP server, for example with
+// mux.Handle("/api/rpc", rs).  The websocket endpoint is served separately
+// by WebsocketHandler.
+func (rs *RpcServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		errCode := http.StatusMethodNotAllowed
+		http.Error(w, fmt.Sprintf("%d method not allowed", errCode),
+			errCode)
+		return
+	}
+	if rs.hijacks(w) {
+		w.Header().Set("Connection", "close")
+		r.Close = true
+	}
+	w.Header().Set("Content-Type", "application/json")
+
+	// 认证失败的客户端按IP限流，在检查认证信息之前拒绝
+	if err := rs.allowAuth(r.RemoteAddr); err != nil {
+		jsonRateLimited(w, err)
 		return
 	}
-	conn, buf, err := hj.Hijack()
+
+	// 检查用户认证信息
+	principal, err := rs.authenticate(r)
 	if err != nil {
-		rlog.Errorf("Failed to hijack HTTP connection: %v", err)
-		errCode := http.StatusInternalServerError
-		http.Error(w, strconv.Itoa(errCode)+""+err.Error(), errCode)
-	}
-	defer conn.Close()
-	defer buf.Flush()
-	// TODO conn.SetReadDeadline(timeZeroVal)
-	// 把body信息解析成JOSN-RPC requests
-	var responseID interface{}
+		rs.authFailed(r.RemoteAddr)
+		jsonAuthFail(w, rs.authChallenge(r))
+		return
+	}
+
+	if err := rs.allowRequest(principal, r.RemoteAddr); err != nil {
+		jsonRateLimited(w, err)
+		return
+	}
+
+	// Read and respond to the request.
+	rs.jsonRPCRead(w, r, principal)
+}
+
+// batchedRequestPrefix is the first non-whitespace character of a JSON-RPC
+// 2.0 batch request.
+var batchedRequestPrefix = []byte("[")
+
+// processRequest parses a single JSON-RPC request into a known concrete
+// command, runs its handler with a context derived from the passed connection
+// context and returns the marshalled reply along with the error it carries,
+// if any.  A nil reply means the request was a notification or the reply
+// could not be marshalled.
+func (rs *RpcServer) processRequest(ctx context.Context, request *Request) ([]byte, error) {
+	var result interface{}
 	var jsonErr error
-	var result interface{} // 处理后的结果
-	var request Request
-	if err := json.Unmarshal(body, &request); err != nil {
-		jsonErr = RPCError{
+
+	// 在解析之前检查权限，这样不允许调用的方法不会泄露参数错误
+	// 把json-rpc请求request解析成一个具体的command
+	var parsedCmd *ParsedRPCCmd
+	if err := rs.authorize(request.Method, PrincipalFromContext(ctx)); err != nil {
+		jsonErr = err
+	} else if parsedCmd = rs.parseCmd(request); parsedCmd.Err != nil {
+		jsonErr = parsedCmd.Err
+	} else {
+		ctx, cancel := requestContext(ctx, request)
+		result, jsonErr = rs.standardCmdResult(ctx, parsedCmd)
+		cancel()
+	}
+
+	// 通知也要执行，但是不能回复
+	if rs.isNotification(request) {
+		return nil, jsonErr
+	}
+
+	// Marshal the response.
+	msg, err := createMarshalledReply(request.Jsonrpc, request.ID, result,
+		jsonErr)
+	if err != nil {
+		rlog.Errorf("Failed to marshal reply for <%s> command: %v",
+			request.Method, err)
+		return nil, jsonErr
+	}
+	return msg, jsonErr
+}
+
+// processBatch handles a JSON-RPC 2.0 batch request.  Every element is parsed
+// and executed on its own, up to MaxConcurrentBatch of them at the same time,
+// and the replies are returned as a single array in request order.
+// Notifications are executed but left out of the array.  When the batch only
+// consists of notifications nil is returned since nothing must be replied.
+// Every element counts against the rate limit, and the elements over it are
+// answered with ErrRPCRateLimited.
+func (rs *RpcServer) processBatch(body []byte, activeReq *activeRequest) []byte {
+	var batchedRequests []json.RawMessage
+	if err := json.Unmarshal(body, &batchedRequests); err != nil {
+		jsonErr := RPCError{
 			Code:    ErrRPCParse.Code,
 			Message: "Failed to parse request: " + err.Error(),
 		}
+		return marshalBatchError(jsonErr)
+	}
+	if len(batchedRequests) == 0 {
+		jsonErr := RPCError{
+			Code:    ErrRPCInvalidRequest.Code,
+			Message: "Invalid request: empty batch",
+		}
+		return marshalBatchError(jsonErr)
 	}
-	rlog.Debugf("After Unmarshal get request:%v", request)
-	if jsonErr == nil {
-		// json-rpc 1.0规范：通知必须将字段id设置为null。通知是不需要response的
-		// json-rpc 2.0规范：通知的request必须有`json-rpc`字段，并且没有id字段。
-		// 2.0 规定通知的话一定不要回复。
-		// 2.0规范容许id值设置为null，因此即使id为null，也不是一个通知。（通知直接就没有id，上面刚说了）
+	rs.setRequestInfo(activeReq, nil,
+		fmt.Sprintf("batch of %d requests", len(batchedRequests)))
 
-		// Bitcoin Core 中，如果请求的id为null，或者没有id字段，也会有回应，
-		// response中id字段的值也为null
+	limit := rs.Config.MaxConcurrentBatch
+	if limit <= 0 {
+		limit = 1
+	}
+	sem := make(chan struct{}, limit)
+	replies := make([]json.RawMessage, len(batchedRequests))
+	principal := PrincipalFromContext(activeReq.ctx)
+	var wg sync.WaitGroup
+	for i, rawRequest := range batchedRequests {
+		var request Request
+		if err := unmarshalRequest(rawRequest, &request); err != nil {
+			reply, err := invalidRequestReply(rawRequest, err,
+				RPCVersion2)
+			if err != nil {
+				rlog.Errorf("Failed to marshal reply: %v", err)
+				continue
+			}
+			replies[i] = reply
+			continue
+		}
+
+		// 每个元素都消耗一个令牌，第一个已经在ServeHTTP中扣除
+		if i > 0 {
+			jsonErr := rs.allowRequest(principal, activeReq.remoteAddr)
+			if jsonErr != nil {
+				if rs.isNotification(&request) {
+					continue
+				}
+				reply, err := createMarshalledReply(request.Jsonrpc,
+					request.ID, nil, jsonErr)
+				if err != nil {
+					rlog.Errorf("Failed to marshal reply: %v", err)
+					continue
+				}
+				replies[i] = reply
+				continue
+			}
+		}
 
-		// Btcd中，任何请求如果没有id字段或者id值为null，都不会回应，而不管json-rpc协议版本。除非
-		// rpc quirks是允许的。RPCQuirks 就是一个字段。
-		// 	RPCQuirks            bool          `long:"rpcquirks" description:"Mirror some JSON-RPC quirks of Bitcoin Core -- NOTE: Discouraged unless interoperability issues need to be worked around"`
-		// 如果RPC quirks允许，这样的请求也会回应，如果请求没有指定json-rpc版本
+		sem <- struct{}{}
+		wg.Add(1)
+		go func(i int, request *Request) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			replies[i], _ = rs.processRequest(activeReq.ctx, request)
+		}(i, &request)
+	}
+	wg.Wait()
 
-		if request.ID == nil && (rs.Config.RPCQuirks && request.Jsonrpc == "") {
+	results := make([]json.RawMessage, 0, len(replies))
+	for _, reply := range replies {
+		if reply != nil {
+			results = append(results, reply)
+		}
+	}
+	if len(results) == 0 {
+		return nil
+	}
+	msg, err := json.Marshal(results)
+	if err != nil {
+		rlog.Errorf("Failed to marshal batch reply: %v", err)
+		return marshalBatchError(internalRPCError(err.Error(), "batch"))
+	}
+	return msg
+}
+
+// marshalBatchError returns the reply for a batch request that failed as a
+// whole, which per the JSON-RPC 2.0 spec is a single error response rather
+// than an array.
+func marshalBatchError(jsonErr error) []byte {
+	msg, err := createMarshalledReply(RPCVersion2, nil, nil, jsonErr)
+	if err != nil {
+		rlog.Errorf("Failed to marshal reply: %v", err)
+		return nil
+	}
+	return msg
+}
+
+func (rs *RpcServer) jsonRPCRead(w http.ResponseWriter, r *http.Request, principal *Principal) {
+	// 服务器正在关闭的话，不再接受新的请求
+	activeReq := rs.trackRequest(&RequestInfo{
+		RemoteAddr: r.RemoteAddr,
+		Principal:  principal,
+		Transport:  TransportHTTP,
+	})
+	if activeReq == nil {
+		errCode := http.StatusServiceUnavailable
+		http.Error(w, fmt.Sprintf("%d server is shutting down", errCode),
+			errCode)
+		return
+	}
+	defer rs.untrackRequest(activeReq)
+
+	// 超过大小限制的请求在读取任何内容之前就被拒绝，
+	// MaxBytesReader保证body不会被读取超过maxSize个字节
+	maxSize := rs.maxRequestBodySize()
+	if r.ContentLength > maxSize {
+		jsonBodyTooLarge(w)
+		return
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, maxSize)
+
+	// 打印出请求信息，body只在读取之后以Debug级别打印
+	logRequest(r)
+
+	body, err := ioutil.ReadAll(r.Body)
+	r.Body.Close()
+	if err != nil {
+		// MaxBytesReader fails once the limit is exceeded, after
+		// having returned exactly maxSize bytes.
+		if int64(len(body)) >= maxSize {
+			jsonBodyTooLarge(w)
 			return
 		}
-		// 到这里解析至少是成功的，设置response的ID
-		responseID = request.ID
-		// 设置close通知。因为这个连接已经被Hijacked，在ResponseWriter上的关闭是无效的
-		closeChan := make(chan struct{})
+		errCode := http.StatusBadRequest
+		http.Error(w, fmt.Sprintf("%d error reading json message:%v", errCode, err), errCode)
+		return
+	}
+	rlog.Debugf("receive request body:%s", body)
+	// 客户端断开的时候取消请求的context，Stop超时的时候也会取消
+	var conn net.Conn
+	var buf *bufio.ReadWriter
+	if !rs.hijacks(w) {
+		// 连接没有被Hijack，客户端断开的时候request的context会被取消
+		done := make(chan struct{})
+		defer close(done)
+		go func() {
+			select {
+			case <-r.Context().Done():
+				activeReq.close()
+			case <-done:
+			}
+		}()
+	} else {
+		//获得底层的 TCP 连接，这样才能转发数据，
+		// 所以下面会有 Hijacker 类型转换和 Hijack() 调用，
+		// 它们最终的目的是拿到客户端的 TCP 连接（net.TCPConn）
+		conn, buf, err = w.(http.Hijacker).Hijack()
+		if err != nil {
+			rlog.Errorf("Failed to hijack HTTP connection: %v", err)
+			errCode := http.StatusInternalServerError
+			http.Error(w, strconv.Itoa(errCode)+" "+err.Error(), errCode)
+			return
+		}
+		defer conn.Close()
+		defer buf.Flush()
+
+		// 读取超时只用于读取请求，处理请求期间只需要检测客户端断开。
+		// 写回复的超时在writeHTTPResponse中设置
+		conn.SetReadDeadline(time.Time{})
+
+		// 因为这个连接已经被Hijacked，在ResponseWriter上的关闭是无效的
 		go func() {
 			_, err := conn.Read(make([]byte, 1))
 			if err != nil {
-				close(closeChan)
+				activeReq.close()
 			}
 		}()
-		// TODO 检查用户是否有限制
-		if jsonErr == nil {
-			// 把json-rpc请求request解析成一个具体的command
-			parsedCmd := parseCmd(&request)
-			if parsedCmd.Err != nil {
-				jsonErr = parsedCmd.Err
-			} else {
-				result, jsonErr = rs.standardCmdResult(parsedCmd, closeChan)
+	}
+
+	// 把body信息解析成JOSN-RPC requests，以`[`开头的是批量请求
+	var msg []byte
+	if bytes.HasPrefix(bytes.TrimSpace(body), batchedRequestPrefix) {
+		msg = rs.processBatch(body, activeReq)
+		if msg == nil {
+			// 批量请求中全部都是通知的话，什么都不回复
+			rs.writeHTTPResponse(w, r, conn, buf, http.StatusNoContent, nil)
+			return
+		}
+	} else {
+		var request Request
+		if err := unmarshalRequest(body, &request); err != nil {
+			msg, err = invalidRequestReply(body, err, RPCVersion1)
+			if err != nil {
+				rlog.Errorf("Failed to marshal reply: %v", err)
+				return
+			}
+		} else {
+			rlog.Debugf("After Unmarshal get request:%v", request)
+			rs.setRequestInfo(activeReq, request.ID, request.Method)
+			var jsonErr error
+			msg, jsonErr = rs.processRequest(activeReq.ctx, &request)
+			if rs.isNotification(&request) {
+				rs.writeHTTPResponse(w, r, conn, buf, http.StatusNoContent,
+					nil)
+				return
+			}
+			if msg == nil {
+				return
+			}
+			if isRateLimited(jsonErr) {
+				rs.writeHTTPResponse(w, r, conn, buf,
+					http.StatusTooManyRequests, msg)
+				return
 			}
 		}
 	}
-	// Marshal the response.
-	msg, err := createMarshalledReply(responseID, result, jsonErr)
+
+	rs.writeHTTPResponse(w, r, conn, buf, http.StatusOK, msg)
+}
+
+// redactedHeaders are the request headers carrying credentials, whose values
+// are never logged.
+var redactedHeaders = []string{"Authorization", "Proxy-Authorization", "Cookie"}
+
+// logRequest logs the request line and headers of the passed request.
+func logRequest(r *http.Request) {
+	byteReq, err := dumpRequest(r)
 	if err != nil {
-		rlog.Errorf("Failed to marshal reply: %v", err)
+		rlog.Errorf("Failed to dump request: %v", err)
 		return
 	}
+	rlog.Infof("receive request:%v", string(byteReq))
+}
 
-	// Write the response.
-	err = rs.writeHTTPResponseHeaders(r, w.Header(), http.StatusOK, buf)
+// dumpRequest returns the request line and headers of the passed request,
+// with the values of redactedHeaders replaced.
+func dumpRequest(r *http.Request) ([]byte, error) {
+	logReq := *r
+	logReq.Header = make(http.Header, len(r.Header))
+	for key, values := range r.Header {
+		logReq.Header[key] = values
+	}
+	for _, key := range redactedHeaders {
+		if logReq.Header.Get(key) != "" {
+			logReq.Header.Set(key, "[redacted]")
+		}
+	}
+	return httputil.DumpRequest(&logReq, false)
+}
+
+// maxRequestBodySize returns the maximum size of a request body or websocket
+// message.
+func (rs *RpcServer) maxRequestBodySize() int64 {
+	if rs.Config.MaxRequestBodySize > 0 {
+		return rs.Config.MaxRequestBodySize
+	}
+	return defaultMaxRequestBodySize
+}
+
+// jsonBodyTooLarge sends a message back to the client if the request body
+// exceeds the maximum size.
+func jsonBodyTooLarge(w http.ResponseWriter) {
+	jsonErr := &RPCError{
+		Code:    ErrRPCInvalidRequest.Code,
+		Message: "Request body too large",
+	}
+	msg, err := createMarshalledReply(RPCVersion1, nil, nil, jsonErr)
 	if err != nil {
-		rlog.Error(err)
+		rlog.Errorf("Failed to marshal reply: %v", err)
 		return
 	}
-	if _, err := buf.Write(msg); err != nil {
+	w.WriteHeader(http.StatusRequestEntityTooLarge)
+	w.Write(msg)
+}
+
+// writeHTTPResponse writes the passed reply with the given status code.  When
+// the connection was hijacked conn is the connection and buf its buffered
+// reader and writer, and the response is written by hand within WriteTimeout
+// so a client that does not read the reply can not hold the connection.
+// Otherwise it goes through the ResponseWriter so the connection can be kept
+// alive.  A nil msg writes the headers only.
+func (rs *RpcServer) writeHTTPResponse(w http.ResponseWriter, r *http.Request, conn net.Conn, buf *bufio.ReadWriter, code int, msg []byte) {
+	var out io.Writer = buf
+	if buf == nil {
+		w.WriteHeader(code)
+		out = w
+	} else {
+		writeTimeout := rs.Config.WriteTimeout
+		if writeTimeout <= 0 {
+			writeTimeout = defaultHijackedWriteTimeout
+		}
+		conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+
+		err := rs.writeHTTPResponseHeaders(r, w.Header(), code, buf)
+		if err != nil {
+			rlog.Error(err)
+			return
+		}
+	}
+	if msg == nil {
+		return
+	}
+
+	// Write the response.
+	if _, err := out.Write(msg); err != nil {
 		rlog.Errorf("Failed to write marshalled reply: %v", err)
 	}
 
 	// Terminate with newline to maintain compatibility with Bitcoin Core.
-	if err := buf.WriteByte('\n'); err != nil {
+	if _, err := io.WriteString(out, "\n"); err != nil {
 		rlog.Errorf("Failed to append terminating newline to reply: %v", err)
 	}
 }
@@ -172,13 +953,16 @@ type ParsedRPCCmd struct {
 	Err    *RPCError   `json:"err"`
 }
 
-func parseCmd(request *Request) *ParsedRPCCmd {
+func (s *RpcServer) parseCmd(request *Request) *ParsedRPCCmd {
 	var parsedCmd ParsedRPCCmd
 	parsedCmd.Id = request.ID
 	parsedCmd.Method = request.Method
-	cmd, err := UnmarshalCmd(request)
+	cmd, err := s.registry.UnmarshalCmd(request)
 	if err != nil {
-		rlog.Infof("rpcjson.UnmarshalCmd error:%v", err)
+		// 未注册的方法对应Method not found，其他的都是参数错误
+		rlog.Debugf("UnmarshalCmd error: %v", err)
+		parsedCmd.Err = toRPCError(err)
+		return &parsedCmd
 	}
 	parsedCmd.Cmd = cmd
 	return &parsedCmd
@@ -188,22 +972,133 @@ func parseCmd(request *Request) *ParsedRPCCmd {
 // standardCmdResult checks that a parsed command is a standard Bitcoin JSON-RPC
 // command and runs the appropriate handler to reply to the command.  Any
 // commands which are not recognized or not implemented will return an error
-// suitable for use in replies.
-func (s *RpcServer) standardCmdResult(cmd *ParsedRPCCmd, closeChan <-chan struct{}) (interface{}, error) {
-	handler, ok := rpcHandlers[cmd.Method]
+// suitable for use in replies.  The caller must have checked the principal of
+// the request may call the method with authorize.
+func (s *RpcServer) standardCmdResult(ctx context.Context, cmd *ParsedRPCCmd) (interface{}, error) {
+	handler, ok := s.registry.rpcHandler(cmd.Method)
 	if ok {
 		goto handled
 	}
-	// TODO
-	//_, ok = rpcUnimplemented[cmd.method]
-	//if ok {
-	//	handler = handleUnimplemented
-	//	goto handled
-	//}
-	//return nil, btcjson.ErrRPCMethodNotFound
+	_, ok = s.registry.wsHandler(cmd.Method)
+	if ok {
+		return nil, &RPCError{
+			Code:    ErrRPCMethodNotFound.Code,
+			Message: "Method is only available over websockets",
+		}
+	}
+	if s.registry.isUnimplemented(cmd.Method) {
+		handler = handleUnimplemented
+		goto handled
+	}
+	return nil, ErrRPCMethodNotFound
 handled:
 
-	return handler(s, cmd.Cmd, closeChan)
+	return s.runHandler(ctx, cmd.Method, func(ctx context.Context) (interface{}, error) {
+		return handler(ctx, s, cmd.Cmd)
+	})
+}
+
+// handlerResult is the outcome of a handler run by runHandler.
+type handlerResult struct {
+	result interface{}
+	err    error
+}
+
+// runHandler runs the passed handler of a method once a handler slot is
+// available, recovering from panics in the handler.  When the method has a
+// timeout, or the server a HandlerTimeout, the handler runs with a context
+// that expires after it and ErrRPCTimeout is returned once it did, without
+// waiting for a handler that ignores the cancellation.  The handler slot is
+// held until the handler returned, and such a handler stays tracked as an
+// in-flight request so Stop waits for it and reports it when aborted.  It must
+// be called for a tracked request.
+func (s *RpcServer) runHandler(ctx context.Context, method string, handler func(context.Context) (interface{}, error)) (interface{}, error) {
+	release, err := s.acquireHandler(method)
+	if err != nil {
+		return nil, err
+	}
+
+	timeout := s.registry.methodTimeout(method)
+	if timeout <= 0 {
+		timeout = s.Config.HandlerTimeout
+	}
+	if timeout <= 0 {
+		defer release()
+		return s.callHandler(ctx, method, handler)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	started := time.Now()
+	done := make(chan handlerResult, 1)
+
+	// The handler goroutine is counted in wg until it returns, even when
+	// it outlives the request.  Adding to wg is safe during Stop since the
+	// calling request is still tracked.  finished and orphan are protected
+	// by activeLock.
+	var finished bool
+	var orphan *activeRequest
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		defer release()
+		result, err := s.callHandler(ctx, method, handler)
+		done <- handlerResult{result, err}
+
+		s.activeLock.Lock()
+		finished = true
+		if orphan != nil {
+			delete(s.activeReqs, orphan)
+		}
+		s.activeLock.Unlock()
+	}()
+
+	select {
+	case res := <-done:
+		if ctx.Err() != context.DeadlineExceeded {
+			return res.result, res.err
+		}
+	case <-ctx.Done():
+		// Wait for the handler to abort when the request was cancelled
+		// for another reason, such as the client disconnecting.
+		if ctx.Err() != context.DeadlineExceeded {
+			res := <-done
+			return res.result, res.err
+		}
+	}
+
+	atomic.AddUint64(&s.timeouts, 1)
+	var id interface{}
+	var remoteAddr string
+	if info, ok := RequestInfoFromContext(ctx); ok {
+		id = info.ID
+		remoteAddr = info.RemoteAddr
+	}
+	rlog.Warnf("Handler for <%s> from %s timed out after %v", method,
+		remoteAddr, timeout)
+
+	// Keep reporting a handler that ignores the cancellation as in-flight
+	// after the request itself is done.
+	s.activeLock.Lock()
+	if !finished {
+		orphan = &activeRequest{
+			id:         id,
+			method:     method,
+			remoteAddr: remoteAddr,
+			started:    started,
+			ctx:        ctx,
+			cancel:     cancel,
+		}
+		s.activeReqs[orphan] = struct{}{}
+	}
+	s.activeLock.Unlock()
+	return nil, ErrRPCTimeout
+}
+
+// HandlerTimeouts returns the number of handlers that exceeded their timeout
+// since the server was created.
+func (s *RpcServer) HandlerTimeouts() uint64 {
+	return atomic.LoadUint64(&s.timeouts)
 }
 
 // writeHTTPResponseHeaders writes the necessary response headers prior to
@@ -261,20 +1156,132 @@ func (rs *RpcServer) httpStatusLine(req *http.Request, code int) string {
 	return line
 }
 
+// isNotification returns whether the passed request is a notification that
+// must not be replied to.
+//
+// json-rpc 1.0规范：通知必须将字段id设置为null。通知是不需要response的
+// json-rpc 2.0规范：通知的request必须有`json-rpc`字段，并且没有id字段。
+// 2.0 规定通知的话一定不要回复。
+// 2.0规范容许id值设置为null，因此即使id为null，也不是一个通知。（通知直接就没有id，上面刚说了）
+//
+// Bitcoin Core 中，如果请求的id为null，或者没有id字段，也会有回应，
+// response中id字段的值也为null
+//
+// Btcd中，任何请求如果没有id字段或者id值为null，都不会回应，而不管json-rpc协议版本。除非
+// rpc quirks是允许的。
+// 如果RPC quirks允许，这样的请求也会回应，如果请求没有指定json-rpc版本
+func (rs *RpcServer) isNotification(request *Request) bool {
+	if rs.Config.RPCQuirks && request.Jsonrpc == "" {
+		return false
+	}
+	return request.IsNotification()
+}
+
+// invalidRequestReply returns the reply to a request that failed to unmarshal
+// with the passed error.  Bytes that are not JSON are answered with
+// ErrRPCParse, JSON that is not a valid request object with
+// ErrRPCInvalidRequest.  The reply carries the jsonrpc version and id of the
+// request when they can be decoded, and rpcVersion otherwise.
+func invalidRequestReply(raw []byte, err error, rpcVersion string) ([]byte, error) {
+	jsonErr := &RPCError{
+		Code:    ErrRPCInvalidRequest.Code,
+		Message: "Invalid request: " + err.Error(),
+	}
+	if !json.Valid(raw) {
+		jsonErr = &RPCError{
+			Code:    ErrRPCParse.Code,
+			Message: "Failed to parse request: " + err.Error(),
+		}
+	}
+
+	var id interface{}
+	var fields map[string]json.RawMessage
+	if json.Unmarshal(raw, &fields) == nil {
+		var version string
+		if json.Unmarshal(fields["jsonrpc"], &version) == nil &&
+			(version == RPCVersion1 || version == RPCVersion2) {
+
+			rpcVersion = version
+		}
+		// Only strings and numbers are valid ids, they are echoed
+		// verbatim.
+		var rawID interface{}
+		if json.Unmarshal(fields["id"], &rawID) == nil {
+			switch rawID.(type) {
+			case string, float64:
+				id = fields["id"]
+			}
+		}
+	}
+	return createMarshalledReply(rpcVersion, id, nil, jsonErr)
+}
+
 // createMarshalledReply returns a new marshalled JSON-RPC response given the
-// passed parameters.  It will automatically convert errors that are not of
-// the type *btcjson.RPCError to the appropriate type as needed.
-func createMarshalledReply(id, result interface{}, replyErr error) ([]byte, error) {
-	var jsonErr *btcjson.RPCError
+// passed parameters.  The envelope mirrors the JSON-RPC version of the
+// request.  It will automatically convert errors that are not of the type
+// *RPCError to the appropriate type as needed.
+func createMarshalledReply(rpcVersion string, id, result interface{}, replyErr error) ([]byte, error) {
+	var jsonErr *RPCError
 	if replyErr != nil {
-		if jErr, ok := replyErr.(*btcjson.RPCError); ok {
-			jsonErr = jErr
-		} else {
-			jsonErr = internalRPCError(replyErr.Error(), "")
-		}
+		jsonErr = toRPCError(replyErr)
 	}
 
-	return btcjson.MarshalResponse(id, result, jsonErr)
+	return MarshalResponse(rpcVersion, id, result, jsonErr)
+}
+
+// toRPCError converts an error returned while parsing or handling a request to
+// the error sent to the client:
+//
+//   - *RPCError and RPCError values are passed through unchanged
+//   - *btcjson.RPCError values keep their code and message
+//   - Error values with ErrUnregisteredMethod become ErrRPCMethodNotFound
+//   - Error values with ErrNumParams, ErrInvalidType, ErrUnknownParam,
+//     ErrMissingParam or ErrDuplicateParam become ErrRPCInvalidParams with
+//     the detailed message and a ParamErrorData as data
+//   - *json.SyntaxError values become ErrRPCParse with the detailed message
+//   - errors wrapping an RPCError, e.g. with fmt.Errorf("...: %w", err),
+//     become the wrapped RPCError
+//   - everything else becomes ErrRPCInternal and is logged
+func toRPCError(err error) *RPCError {
+	switch e := err.(type) {
+	case *RPCError:
+		return e
+	case RPCError:
+		return &e
+	case *btcjson.RPCError:
+		return &RPCError{
+			Code:    RPCErrorCode(e.Code),
+			Message: e.Message,
+		}
+	case *Error:
+		return toRPCError(*e)
+	case Error:
+		switch e.ErrorCode {
+		case ErrUnregisteredMethod:
+			return ErrRPCMethodNotFound
+		case ErrNumParams, ErrInvalidType, ErrUnknownParam,
+			ErrMissingParam, ErrDuplicateParam:
+
+			jsonErr := &RPCError{
+				Code:    ErrRPCInvalidParams.Code,
+				Message: e.Description,
+			}
+			if e.Param != nil {
+				jsonErr.Data = e.Param
+			}
+			return jsonErr
+		}
+	case *json.SyntaxError:
+		return &RPCError{
+			Code:    ErrRPCParse.Code,
+			Message: "Failed to parse request: " + e.Error(),
+		}
+	}
+	var rpcErr *RPCError
+	if errors.As(err, &rpcErr) {
+		return rpcErr
+	}
+	return internalRPCError(err.Error(), "")
 }
 
 // internalRPCError is a convenience function to convert an internal error to
@@ -282,16 +1289,18 @@ func createMarshalledReply(id, result interface{}, replyErr error) ([]byte, erro
 // RPC server subsystem since internal errors really should not occur.  The
 // context parameter is only used in the log message and may be empty if it's
 // not needed.
-func internalRPCError(errStr, context string) *btcjson.RPCError {
+func internalRPCError(errStr, context string) *RPCError {
 	logStr := errStr
 	if context != "" {
 		logStr = context + ": " + errStr
 	}
 	rlog.Error(logStr)
-	return btcjson.NewRPCError(btcjson.ErrRPCInternal.Code, errStr)
+	return &RPCError{
+		Code:    ErrRPCInternal.Code,
+		Message: errStr,
+	}
 }
 
-
 func init() {
 
 }
@@ -0,0 +1,1084 @@
+package gorpc
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gorilla/websocket"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httptrace"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestListenAddrs ensures the server binds every configured address, reports
+// the actual ephemeral ports and rejects malformed addresses.
+func TestListenAddrs(t *testing.T) {
+	rs, err := NewRpcServer(&RpcServerConfig{
+		ListenAddrs: []string{"127.0.0.1:0", "localhost:0"},
+		Registry:    NewRegistry(),
+	})
+	if err != nil {
+		t.Fatalf("NewRpcServer: unexpected error: %v", err)
+	}
+	defer closeListeners(rs.listeners)
+
+	addrs := rs.Addrs()
+	if len(addrs) != 2 {
+		t.Fatalf("Addrs: got %d addresses, want 2", len(addrs))
+	}
+	for _, addr := range addrs {
+		_, port, err := net.SplitHostPort(addr.String())
+		if err != nil || port == "0" {
+			t.Errorf("Addrs: address %v has no bound port", addr)
+		}
+	}
+
+	tests := []string{"127.0.0.1", "256.0.0.1:0", "[::1"}
+	for _, addr := range tests {
+		_, err := NewRpcServer(&RpcServerConfig{
+			ListenAddrs: []string{addr},
+		})
+		if err == nil {
+			t.Errorf("NewRpcServer(%q): expected error", addr)
+		}
+	}
+}
+
+// blockCmd is the parameterless command of the handlers registered by the
+// tests, for example one that blocks until it is told to abort.
+type blockCmd struct{}
+
+// TestStop ensures Stop stops accepting requests and aborts handlers that are
+// still running once the shutdown deadline passed.
+func TestStop(t *testing.T) {
+	running := make(chan struct{})
+	aborted := make(chan struct{})
+	registry := newTestRegistry(t)
+	registry.Register("teststopblock", (*blockCmd)(nil), func(s *RpcServer, cmd interface{}, closeChan <-chan struct{}) (interface{}, error) {
+		close(running)
+		<-closeChan
+		close(aborted)
+		return nil, nil
+	}, 0)
+
+	rs, err := NewRpcServer(&RpcServerConfig{
+		Registry:        registry,
+		ListenAddrs:     []string{"127.0.0.1:0"},
+		ShutdownTimeout: 50 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatalf("NewRpcServer: unexpected error: %v", err)
+	}
+	startErr := make(chan error, 1)
+	go func() { startErr <- rs.Start() }()
+
+	url := "http://" + rs.Addrs()[0].String()
+	go http.Post(url, "application/json", strings.NewReader(
+		`{"jsonrpc":"1.0","method":"teststopblock","params":[],"id":7}`))
+	<-running
+
+	abortedReqs, err := rs.Stop()
+	if err != nil {
+		t.Fatalf("Stop: unexpected error: %v", err)
+	}
+	if len(abortedReqs) != 1 || abortedReqs[0].Method != "teststopblock" {
+		t.Fatalf("Stop: unexpected aborted requests %+v", abortedReqs)
+	}
+	select {
+	case <-aborted:
+	case <-time.After(time.Second):
+		t.Fatal("handler was not signalled to abort")
+	}
+	if err := <-startErr; err != nil {
+		t.Fatalf("Start: unexpected error: %v", err)
+	}
+	if _, err := rs.Stop(); err == nil {
+		t.Fatal("Stop: expected error when stopping twice")
+	}
+	if err := rs.Start(); err == nil {
+		t.Fatal("Start: expected error after server stopped")
+	}
+	if _, err := http.Post(url, "application/json", nil); err == nil {
+		t.Fatal("Post: expected error after server stopped")
+	}
+}
+
+// TestTLS ensures a self-signed certificate is generated on first start and
+// the server answers over TLS.
+func TestTLS(t *testing.T) {
+	dir := t.TempDir()
+	config := &RpcServerConfig{
+		ListenAddrs: []string{"127.0.0.1:0"},
+		EnableTLS:   true,
+		RPCCert:     filepath.Join(dir, "rpc.cert"),
+		RPCKey:      filepath.Join(dir, "rpc.key"),
+		Registry:    newTestRegistry(t),
+	}
+	rs, err := NewRpcServer(config)
+	if err != nil {
+		t.Fatalf("NewRpcServer: unexpected error: %v", err)
+	}
+	if !fileExists(config.RPCCert) || !fileExists(config.RPCKey) {
+		t.Fatal("NewRpcServer: certificate pair was not generated")
+	}
+	go rs.Start()
+	defer rs.Stop()
+
+	pem, err := ioutil.ReadFile(config.RPCCert)
+	if err != nil {
+		t.Fatalf("ReadFile: unexpected error: %v", err)
+	}
+	pool := x509.NewCertPool()
+	pool.AppendCertsFromPEM(pem)
+	client := &http.Client{Transport: &http.Transport{
+		TLSClientConfig: &tls.Config{RootCAs: pool},
+	}}
+	resp, err := client.Post("https://"+rs.Addrs()[0].String(),
+		"application/json", strings.NewReader(
+			`{"jsonrpc":"1.0","method":"getreadme","params":[],"id":1}`))
+	if err != nil {
+		t.Fatalf("Post: unexpected error: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Post: unexpected status %v", resp.Status)
+	}
+}
+
+// postJSON posts body to the RPC server at addr and returns the reply body.
+func postJSON(t *testing.T, addr, body string) []byte {
+	t.Helper()
+	resp, err := http.Post("http://"+addr, "application/json",
+		strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("Post: unexpected error: %v", err)
+	}
+	defer resp.Body.Close()
+	reply, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("ReadAll: unexpected error: %v", err)
+	}
+	return reply
+}
+
+// TestBatch ensures JSON-RPC 2.0 batch requests are answered with a single
+// array that leaves out notifications.
+func TestBatch(t *testing.T) {
+	_, addr := newTestServer(t, &RpcServerConfig{MaxConcurrentBatch: 4})
+
+	reply := postJSON(t, addr, `[
+		{"jsonrpc":"2.0","method":"getreadme","params":[],"id":1},
+		{"jsonrpc":"2.0","method":"getreadme","params":[]},
+		1,
+		{"jsonrpc":"2.0","method":"getreadme","params":[],"id":"b"}
+	]`)
+	var replies []struct {
+		ID    interface{}       `json:"id"`
+		Error *RPCError         `json:"error"`
+		Res   *GetReadMeReasult `json:"result"`
+	}
+	if err := json.Unmarshal(reply, &replies); err != nil {
+		t.Fatalf("Unmarshal %s: unexpected error: %v", reply, err)
+	}
+	if len(replies) != 3 {
+		t.Fatalf("got %d replies, want 3: %s", len(replies), reply)
+	}
+	if replies[0].ID != 1.0 || replies[0].Res == nil {
+		t.Errorf("unexpected first reply %+v", replies[0])
+	}
+	if replies[1].Error == nil || replies[1].Error.Code != ErrRPCInvalidRequest.Code {
+		t.Errorf("unexpected invalid entry reply %+v", replies[1])
+	}
+	if replies[2].ID != "b" || replies[2].Res == nil {
+		t.Errorf("unexpected last reply %+v", replies[2])
+	}
+
+	var single struct {
+		Error *RPCError `json:"error"`
+	}
+	reply = postJSON(t, addr, ` [ ] `)
+	if err := json.Unmarshal(reply, &single); err != nil {
+		t.Fatalf("Unmarshal %s: unexpected error: %v", reply, err)
+	}
+	if single.Error == nil || single.Error.Code != ErrRPCInvalidRequest.Code {
+		t.Errorf("empty batch: unexpected reply %s", reply)
+	}
+
+	reply = postJSON(t, addr,
+		`[{"jsonrpc":"2.0","method":"getreadme","params":[]}]`)
+	if len(strings.TrimSpace(string(reply))) != 0 {
+		t.Errorf("notification batch: unexpected reply %s", reply)
+	}
+}
+
+// TestResponseEnvelope ensures replies mirror the JSON-RPC version of the
+// request and notifications are not answered.
+func TestResponseEnvelope(t *testing.T) {
+	registry := newTestRegistry(t)
+	registry.Register("testfail", (*blockCmd)(nil), func(s *RpcServer, cmd interface{}, closeChan <-chan struct{}) (interface{}, error) {
+		return nil, ErrRPCInvalidParams
+	}, 0)
+	_, addr := newTestServer(t, &RpcServerConfig{Registry: registry})
+	_, quirksAddr := newTestServer(t, &RpcServerConfig{
+		Registry:  registry,
+		RPCQuirks: true,
+	})
+
+	tests := []struct {
+		name    string
+		addr    string
+		body    string
+		members []string // nil when no reply is expected
+	}{
+		{
+			name:    "2.0 request",
+			addr:    addr,
+			body:    `{"jsonrpc":"2.0","method":"getreadme","params":[],"id":1}`,
+			members: []string{"id", "jsonrpc", "result"},
+		},
+		{
+			name:    "2.0 error",
+			addr:    addr,
+			body:    `{"jsonrpc":"2.0","method":"testfail","params":[],"id":1}`,
+			members: []string{"error", "id", "jsonrpc"},
+		},
+		{
+			name:    "2.0 null id",
+			addr:    addr,
+			body:    `{"jsonrpc":"2.0","method":"getreadme","params":[],"id":null}`,
+			members: []string{"id", "jsonrpc", "result"},
+		},
+		{
+			name: "2.0 notification",
+			addr: addr,
+			body: `{"jsonrpc":"2.0","method":"getreadme","params":[]}`,
+		},
+		{
+			name:    "1.0 request",
+			addr:    addr,
+			body:    `{"method":"getreadme","params":[],"id":1}`,
+			members: []string{"error", "id", "result"},
+		},
+		{
+			name: "1.0 notification",
+			addr: addr,
+			body: `{"method":"getreadme","params":[],"id":null}`,
+		},
+		{
+			name:    "quirks without version",
+			addr:    quirksAddr,
+			body:    `{"method":"getreadme","params":[]}`,
+			members: []string{"error", "id", "result"},
+		},
+		{
+			name: "quirks with version",
+			addr: quirksAddr,
+			body: `{"jsonrpc":"1.0","method":"getreadme","params":[],"id":null}`,
+		},
+	}
+
+	for _, test := range tests {
+		reply := postJSON(t, test.addr, test.body)
+		if test.members == nil {
+			if len(reply) != 0 {
+				t.Errorf("%s: unexpected reply %s", test.name, reply)
+			}
+			continue
+		}
+		var members map[string]json.RawMessage
+		if err := json.Unmarshal(reply, &members); err != nil {
+			t.Errorf("%s: Unmarshal %s: %v", test.name, reply, err)
+			continue
+		}
+		var got []string
+		for member := range members {
+			got = append(got, member)
+		}
+		sort.Strings(got)
+		if !reflect.DeepEqual(got, test.members) {
+			t.Errorf("%s: got members %v, want %v", test.name, got,
+				test.members)
+		}
+	}
+}
+
+// TestHTTPKeepAlive ensures connections are reused in keep-alive mode and
+// handlers are still signalled when the client goes away.
+func TestHTTPKeepAlive(t *testing.T) {
+	running := make(chan struct{})
+	aborted := make(chan struct{})
+	registry := newTestRegistry(t)
+	registry.Register("testkeepaliveblock", (*blockCmd)(nil), func(s *RpcServer, cmd interface{}, closeChan <-chan struct{}) (interface{}, error) {
+		close(running)
+		<-closeChan
+		close(aborted)
+		return nil, nil
+	}, 0)
+	_, addr := newTestServer(t, &RpcServerConfig{
+		Registry:      registry,
+		HTTPKeepAlive: true,
+	})
+
+	body := `{"jsonrpc":"2.0","method":"getreadme","params":[],"id":1}`
+	var reused []bool
+	for i := 0; i < 2; i++ {
+		trace := &httptrace.ClientTrace{
+			GotConn: func(info httptrace.GotConnInfo) {
+				reused = append(reused, info.Reused)
+			},
+		}
+		req, _ := http.NewRequest("POST", "http://"+addr,
+			strings.NewReader(body))
+		req = req.WithContext(httptrace.WithClientTrace(req.Context(), trace))
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Do: unexpected error: %v", err)
+		}
+		ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+	}
+	if len(reused) != 2 || !reused[1] {
+		t.Fatalf("connection was not reused: %v", reused)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	req, _ := http.NewRequest("POST", "http://"+addr, strings.NewReader(
+		`{"jsonrpc":"2.0","method":"testkeepaliveblock","params":[],"id":1}`))
+	go http.DefaultClient.Do(req.WithContext(ctx))
+	<-running
+	cancel()
+	select {
+	case <-aborted:
+	case <-time.After(time.Second):
+		t.Fatal("handler was not signalled on client disconnect")
+	}
+}
+
+// TestServeHTTP ensures the server can be mounted in another HTTP server.
+func TestServeHTTP(t *testing.T) {
+	rs, err := NewRpcServer(&RpcServerConfig{
+		DisableListen: true,
+		Registry:      newTestRegistry(t),
+	})
+	if err != nil {
+		t.Fatalf("NewRpcServer: unexpected error: %v", err)
+	}
+	if len(rs.Addrs()) != 0 {
+		t.Fatalf("Addrs: unexpected addresses %v", rs.Addrs())
+	}
+	if err := rs.Start(); err == nil {
+		t.Fatal("Start: expected error without listeners")
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/api/rpc", rs)
+	mux.HandleFunc("/api/ws", rs.WebsocketHandler)
+	server := httptest.NewServer(mux)
+	defer server.Close()
+	addr := strings.TrimPrefix(server.URL, "http://")
+
+	resp, err := http.Post(server.URL+"/api/rpc", "application/json",
+		strings.NewReader(`{"jsonrpc":"2.0","method":"getreadme","params":[],"id":1}`))
+	if err != nil {
+		t.Fatalf("Post: unexpected error: %v", err)
+	}
+	var reply struct {
+		Result *GetReadMeReasult `json:"result"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&reply)
+	resp.Body.Close()
+	if err != nil || reply.Result == nil {
+		t.Fatalf("Post: unexpected reply %+v (%v)", reply, err)
+	}
+
+	resp, err = http.Get(server.URL + "/api/rpc")
+	if err != nil {
+		t.Fatalf("Get: unexpected error: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Fatalf("Get: unexpected status %v", resp.Status)
+	}
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws://"+addr+"/api/ws", nil)
+	if err != nil {
+		t.Fatalf("Dial: unexpected error: %v", err)
+	}
+	conn.Close()
+
+	// HTTP/2 connections can not be hijacked, so the reply must be
+	// written through the ResponseWriter instead.
+	h2Server := httptest.NewUnstartedServer(mux)
+	h2Server.EnableHTTP2 = true
+	h2Server.StartTLS()
+	defer h2Server.Close()
+	resp, err = h2Server.Client().Post(h2Server.URL+"/api/rpc",
+		"application/json", strings.NewReader(
+			`{"jsonrpc":"2.0","method":"getreadme","params":[],"id":1}`))
+	if err != nil {
+		t.Fatalf("Post: unexpected error: %v", err)
+	}
+	reply.Result = nil
+	err = json.NewDecoder(resp.Body).Decode(&reply)
+	resp.Body.Close()
+	if resp.ProtoMajor != 2 {
+		t.Fatalf("Post: got protocol %v, want HTTP/2", resp.Proto)
+	}
+	if err != nil || resp.StatusCode != http.StatusOK || reply.Result == nil {
+		t.Fatalf("Post over HTTP/2: unexpected reply %v %+v (%v)",
+			resp.Status, reply, err)
+	}
+}
+
+// TestAuth ensures clients must authenticate once credentials are configured
+// and limited users can only call the allowed methods.
+func TestAuth(t *testing.T) {
+	registry := newTestRegistry(t)
+	registry.Register("testadminonly", (*blockCmd)(nil), func(s *RpcServer, cmd interface{}, closeChan <-chan struct{}) (interface{}, error) {
+		return "ok", nil
+	}, 0)
+	_, addr := newTestServer(t, &RpcServerConfig{
+		Registry:          registry,
+		RPCUser:           "admin",
+		RPCPass:           "secret",
+		RPCLimitUser:      "user",
+		RPCLimitPass:      "limited",
+		RPCLimitedMethods: []string{"getreadme"},
+	})
+
+	call := func(user, pass, method, params string) (int, *RPCError) {
+		req, _ := http.NewRequest("POST", "http://"+addr, strings.NewReader(
+			`{"jsonrpc":"2.0","method":"`+method+`","params":`+params+`,"id":1}`))
+		if user != "" {
+			req.SetBasicAuth(user, pass)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Do: unexpected error: %v", err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			if resp.Header.Get("WWW-Authenticate") == "" {
+				t.Errorf("missing WWW-Authenticate header")
+			}
+			return resp.StatusCode, nil
+		}
+		var reply struct {
+			Error *RPCError `json:"error"`
+		}
+		if err := json.NewDecoder(resp.Body).Decode(&reply); err != nil {
+			t.Fatalf("Decode: unexpected error: %v", err)
+		}
+		return resp.StatusCode, reply.Error
+	}
+
+	// Limited users get the same error for methods they may not call
+	// whether the method exists or its params are valid.
+	tests := []struct {
+		user, pass, method string
+		params             string
+		status             int
+		code               RPCErrorCode // 0 when the call is allowed
+	}{
+		{"", "", "getreadme", "[]", http.StatusUnauthorized, 0},
+		{"admin", "wrong", "getreadme", "[]", http.StatusUnauthorized, 0},
+		{"admin", "secret", "testadminonly", "[]", http.StatusOK, 0},
+		{"user", "limited", "getreadme", "[]", http.StatusOK, 0},
+		{"user", "limited", "testadminonly", "[]", http.StatusOK,
+			ErrRPCUnauthorized.Code},
+		{"user", "limited", "testadminonly", "[1]", http.StatusOK,
+			ErrRPCUnauthorized.Code},
+		{"user", "limited", "nosuchmethod", "[]", http.StatusOK,
+			ErrRPCUnauthorized.Code},
+		{"admin", "secret", "nosuchmethod", "[]", http.StatusOK,
+			ErrRPCMethodNotFound.Code},
+	}
+	for _, test := range tests {
+		status, rpcErr := call(test.user, test.pass, test.method,
+			test.params)
+		if status != test.status {
+			t.Errorf("%s/%s: got status %d, want %d", test.user,
+				test.method, status, test.status)
+			continue
+		}
+		if status != http.StatusOK {
+			continue
+		}
+		if test.code == 0 && rpcErr != nil {
+			t.Errorf("%s/%s: unexpected error %v", test.user,
+				test.method, rpcErr)
+		}
+		if test.code != 0 && (rpcErr == nil || rpcErr.Code != test.code) {
+			t.Errorf("%s/%s%s: got error %v, want code %d", test.user,
+				test.method, test.params, rpcErr, test.code)
+		}
+	}
+}
+
+// TestDumpRequest ensures credentials are redacted from logged requests.
+func TestDumpRequest(t *testing.T) {
+	r := httptest.NewRequest("POST", "/", strings.NewReader("{}"))
+	r.SetBasicAuth("admin", "secret")
+	r.Header.Set("X-Other", "kept")
+	dump, err := dumpRequest(r)
+	if err != nil {
+		t.Fatalf("dumpRequest: unexpected error: %v", err)
+	}
+	basic := r.Header.Get("Authorization")
+	if strings.Contains(string(dump), basic) ||
+		!strings.Contains(string(dump), "Authorization: [redacted]") ||
+		!strings.Contains(string(dump), "X-Other: kept") {
+
+		t.Errorf("got dump %q", dump)
+	}
+	if r.Header.Get("Authorization") != basic {
+		t.Error("dumpRequest modified the request headers")
+	}
+}
+
+// headerAuthenticator authenticates requests by the X-Role header, granting
+// the principal the role named in it.
+type headerAuthenticator struct{}
+
+func (headerAuthenticator) Authenticate(r *http.Request) (*Principal, error) {
+	role := r.Header.Get("X-Role")
+	switch role {
+	case "":
+		return nil, nil
+	case "invalid":
+		return nil, errors.New("invalid role")
+	}
+	return &Principal{Name: role, Roles: []string{role}}, nil
+}
+
+// TestRoles ensures methods registered with roles may only be called by
+// principals having one of them or admins.
+func TestRoles(t *testing.T) {
+	registry := newTestRegistry(t)
+	registry.Register("testoperator", (*blockCmd)(nil), func(s *RpcServer, cmd interface{}, closeChan <-chan struct{}) (interface{}, error) {
+		return "ok", nil
+	}, 0, WithRoles("operator", RoleAdmin))
+	registry.Register("testops", (*blockCmd)(nil), func(s *RpcServer, cmd interface{}, closeChan <-chan struct{}) (interface{}, error) {
+		return "ok", nil
+	}, 0, WithRoles("ops"))
+	_, addr := newTestServer(t, &RpcServerConfig{
+		Registry:      registry,
+		Authenticator: headerAuthenticator{},
+	})
+
+	tests := []struct {
+		role, method string
+		status       int
+		code         RPCErrorCode
+	}{
+		{"", "getreadme", http.StatusOK, 0},
+		{"", "testoperator", http.StatusOK, ErrRPCUnauthorized.Code},
+		{"viewer", "testoperator", http.StatusOK, ErrRPCUnauthorized.Code},
+		{"operator", "testoperator", http.StatusOK, 0},
+		{RoleAdmin, "testoperator", http.StatusOK, 0},
+		{"operator", "testops", http.StatusOK, ErrRPCUnauthorized.Code},
+		{"ops", "testops", http.StatusOK, 0},
+		{RoleAdmin, "testops", http.StatusOK, 0},
+		{"invalid", "getreadme", http.StatusUnauthorized, 0},
+	}
+	for _, test := range tests {
+		req, _ := http.NewRequest("POST", "http://"+addr, strings.NewReader(
+			`{"jsonrpc":"2.0","method":"`+test.method+`","params":[],"id":1}`))
+		req.Header.Set("X-Role", test.role)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Do: unexpected error: %v", err)
+		}
+		var reply struct {
+			Error *RPCError `json:"error"`
+		}
+		if resp.StatusCode == http.StatusOK {
+			err = json.NewDecoder(resp.Body).Decode(&reply)
+		}
+		resp.Body.Close()
+		if err != nil {
+			t.Fatalf("Decode: unexpected error: %v", err)
+		}
+		if resp.StatusCode != test.status {
+			t.Errorf("%q/%s: got status %d, want %d", test.role,
+				test.method, resp.StatusCode, test.status)
+			continue
+		}
+		var code RPCErrorCode
+		if reply.Error != nil {
+			code = reply.Error.Code
+		}
+		if code != test.code {
+			t.Errorf("%q/%s: got error %v, want code %d", test.role,
+				test.method, reply.Error, test.code)
+		}
+	}
+}
+
+// TestMaxRequestBodySize ensures oversized request bodies and websocket
+// messages are rejected.
+func TestMaxRequestBodySize(t *testing.T) {
+	_, addr := newTestServer(t, &RpcServerConfig{MaxRequestBodySize: 128})
+
+	small := `{"jsonrpc":"2.0","method":"getreadme","params":[],"id":1}`
+	large := `{"jsonrpc":"2.0","method":"getreadme","params":[],"id":"` +
+		strings.Repeat("x", 128) + `"}`
+
+	for _, body := range []string{small, large} {
+		resp, err := http.Post("http://"+addr, "application/json",
+			strings.NewReader(body))
+		if err != nil {
+			t.Fatalf("Post: unexpected error: %v", err)
+		}
+		var reply struct {
+			Error *RPCError `json:"error"`
+		}
+		err = json.NewDecoder(resp.Body).Decode(&reply)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatalf("Decode: unexpected error: %v", err)
+		}
+
+		wantStatus := http.StatusOK
+		if len(body) > 128 {
+			wantStatus = http.StatusRequestEntityTooLarge
+		}
+		if resp.StatusCode != wantStatus {
+			t.Errorf("%d byte body: got status %d, want %d",
+				len(body), resp.StatusCode, wantStatus)
+		}
+		if (reply.Error != nil) != (len(body) > 128) {
+			t.Errorf("%d byte body: unexpected error %v", len(body),
+				reply.Error)
+		}
+	}
+
+	// A chunked body of unknown length is rejected once the limit is
+	// exceeded instead of being read completely.
+	const chunkSize, numChunks = 64 * 1024, 3200
+	tcpConn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Dial: unexpected error: %v", err)
+	}
+	defer tcpConn.Close()
+	written := make(chan int, 1)
+	go func() {
+		_, err := io.WriteString(tcpConn, "POST / HTTP/1.1\r\n"+
+			"Host: localhost\r\nContent-Type: application/json\r\n"+
+			"Transfer-Encoding: chunked\r\n\r\n")
+		chunk := fmt.Sprintf("%x\r\n%s\r\n", chunkSize,
+			strings.Repeat("x", chunkSize))
+		n := 0
+		for ; err == nil && n < numChunks; n++ {
+			_, err = io.WriteString(tcpConn, chunk)
+		}
+		written <- n
+	}()
+	tcpConn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	resp, err := http.ReadResponse(bufio.NewReader(tcpConn), nil)
+	if err != nil {
+		t.Fatalf("ReadResponse: unexpected error: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Errorf("chunked body: got status %d, want %d", resp.StatusCode,
+			http.StatusRequestEntityTooLarge)
+	}
+	tcpConn.Close()
+	if n := <-written; n >= numChunks {
+		t.Errorf("chunked body: all %d chunks were read", n)
+	}
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws://"+addr+"/ws", nil)
+	if err != nil {
+		t.Fatalf("Dial: unexpected error: %v", err)
+	}
+	defer conn.Close()
+	if err := conn.WriteMessage(websocket.TextMessage, []byte(large)); err != nil {
+		t.Fatalf("WriteMessage: unexpected error: %v", err)
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, _, err = conn.ReadMessage()
+	if !websocket.IsCloseError(err, websocket.CloseMessageTooBig) {
+		t.Fatalf("ReadMessage: got %v, want close for a too big message",
+			err)
+	}
+}
+
+// TestContextHandler ensures handlers registered with RegisterContext receive
+// the request metadata and a context that is cancelled once the client
+// disconnects.
+func TestContextHandler(t *testing.T) {
+	registry := newTestRegistry(t)
+	registry.RegisterContext("testrequestinfo", (*blockCmd)(nil), func(ctx context.Context, s *RpcServer, cmd interface{}) (interface{}, error) {
+		info, ok := RequestInfoFromContext(ctx)
+		if !ok {
+			return nil, errors.New("no request info")
+		}
+		return []interface{}{info.ID, info.Method, info.Transport,
+			info.RemoteAddr != ""}, nil
+	}, 0)
+	running := make(chan struct{})
+	cancelled := make(chan struct{})
+	registry.RegisterContext("testctxblock", (*blockCmd)(nil), func(ctx context.Context, s *RpcServer, cmd interface{}) (interface{}, error) {
+		close(running)
+		<-ctx.Done()
+		close(cancelled)
+		return nil, ctx.Err()
+	}, 0)
+	_, addr := newTestServer(t, &RpcServerConfig{Registry: registry})
+
+	reply := postJSON(t, addr, `{"jsonrpc":"2.0","method":"testrequestinfo","params":[],"id":7}`)
+	want := `{"jsonrpc":"2.0","result":[7,"testrequestinfo","http",true],"id":7}`
+	if got := strings.TrimSpace(string(reply)); got != want {
+		t.Errorf("got reply %s, want %s", got, want)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	req, _ := http.NewRequest("POST", "http://"+addr, strings.NewReader(
+		`{"jsonrpc":"2.0","method":"testctxblock","params":[],"id":1}`))
+	go func() {
+		<-running
+		cancel()
+	}()
+	if _, err := http.DefaultClient.Do(req.WithContext(ctx)); err == nil {
+		t.Fatal("Do: expected error after cancelling the request")
+	}
+	select {
+	case <-cancelled:
+	case <-time.After(5 * time.Second):
+		t.Fatal("handler context was not cancelled on disconnect")
+	}
+}
+
+// TestHandlerTimeout ensures handlers exceeding the timeout of their method,
+// or the HandlerTimeout of the server, are answered with ErrRPCTimeout and
+// handlers ignoring it are still waited for by Stop.
+func TestHandlerTimeout(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	registry := newTestRegistry(t)
+	registry.Register("testignoretimeout", (*blockCmd)(nil), func(s *RpcServer, cmd interface{}, closeChan <-chan struct{}) (interface{}, error) {
+		<-release
+		return "late", nil
+	}, 0, WithTimeout(20*time.Millisecond))
+	registry.RegisterContext("testctxtimeout", (*blockCmd)(nil), func(ctx context.Context, s *RpcServer, cmd interface{}) (interface{}, error) {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}, 0)
+	rs, addr := newTestServer(t, &RpcServerConfig{
+		Registry:        registry,
+		HandlerTimeout:  20 * time.Millisecond,
+		ShutdownTimeout: 50 * time.Millisecond,
+	})
+
+	for _, method := range []string{"testignoretimeout", "testctxtimeout"} {
+		reply := postJSON(t, addr, `{"jsonrpc":"2.0","method":"`+method+
+			`","params":[],"id":1}`)
+		var resp struct {
+			Error *RPCError `json:"error"`
+		}
+		if err := json.Unmarshal(reply, &resp); err != nil {
+			t.Fatalf("Unmarshal: unexpected error: %v", err)
+		}
+		if resp.Error == nil || resp.Error.Code != ErrRPCTimeout.Code {
+			t.Errorf("%s: got reply %s, want timeout error", method,
+				reply)
+		}
+	}
+	if n := rs.HandlerTimeouts(); n != 2 {
+		t.Errorf("got %d timeouts, want 2", n)
+	}
+
+	// The handler ignoring its timeout is still running, so Stop must
+	// not report a clean shutdown.
+	aborted, err := rs.Stop()
+	if err != nil {
+		t.Fatalf("Stop: unexpected error: %v", err)
+	}
+	if len(aborted) != 1 || aborted[0].Method != "testignoretimeout" {
+		t.Errorf("Stop: unexpected aborted requests %+v", aborted)
+	}
+}
+
+// TestPanicRecovery ensures panicking handlers are answered with
+// ErrRPCInternal and reported to the OnPanic hook.
+func TestPanicRecovery(t *testing.T) {
+	registry := newTestRegistry(t)
+	registry.Register("testpanic", (*blockCmd)(nil), func(s *RpcServer, cmd interface{}, closeChan <-chan struct{}) (interface{}, error) {
+		panic("boom")
+	}, 0)
+
+	panics := make(chan *PanicInfo, 1)
+	_, addr := newTestServer(t, &RpcServerConfig{
+		Registry: registry,
+		OnPanic:  func(info *PanicInfo) { panics <- info },
+	})
+
+	reply := postJSON(t, addr, `{"jsonrpc":"2.0","method":"testpanic","params":[],"id":1}`)
+	var resp struct {
+		Error *RPCError `json:"error"`
+	}
+	if err := json.Unmarshal(reply, &resp); err != nil {
+		t.Fatalf("Unmarshal: unexpected error: %v", err)
+	}
+
+	var info *PanicInfo
+	select {
+	case info = <-panics:
+	default:
+		t.Fatal("OnPanic was not called")
+	}
+	if info.Method != "testpanic" || info.Value != "boom" ||
+		len(info.Stack) == 0 || info.Request == nil ||
+		info.Request.Transport != TransportHTTP {
+
+		t.Errorf("unexpected panic info %+v", info)
+	}
+	if resp.Error == nil || resp.Error.Code != ErrRPCInternal.Code ||
+		!strings.Contains(resp.Error.Message, info.IncidentID) {
+
+		t.Errorf("got reply %s, want internal error with incident %s",
+			reply, info.IncidentID)
+	}
+}
+
+// TestMethodNotFound ensures unknown methods and methods without a handler,
+// including ones registered with a nil handler, are answered with ErrRPCMethodNotFound, unimplemented ones with
+// ErrRPCUnimplemented, and that Start reports registry inconsistencies.
+func TestMethodNotFound(t *testing.T) {
+	registry := newTestRegistry(t)
+	registry.MustRegisterCmd("testnohandler", (*blockCmd)(nil), 0)
+	registry.MustRegisterCmd("testunimplemented", (*blockCmd)(nil), 0)
+	registry.AddUnimplemented("testunimplemented")
+	registry.Register("testnilhandler", (*blockCmd)(nil), nil, 0)
+	registry.MustRegisterCmd("testniladded", (*blockCmd)(nil), 0)
+	registry.AddRpcHandler("testniladded", nil)
+	_, addr := newTestServer(t, &RpcServerConfig{Registry: registry})
+
+	tests := []struct {
+		method string
+		code   RPCErrorCode
+	}{
+		{"nosuchmethod", ErrRPCMethodNotFound.Code},
+		{"testnohandler", ErrRPCMethodNotFound.Code},
+		{"testunimplemented", ErrRPCUnimplemented.Code},
+		{"testnilhandler", ErrRPCMethodNotFound.Code},
+		{"testniladded", ErrRPCMethodNotFound.Code},
+	}
+	for _, test := range tests {
+		reply := postJSON(t, addr, `{"jsonrpc":"2.0","method":"`+
+			test.method+`","params":[],"id":1}`)
+		var resp struct {
+			Error *RPCError `json:"error"`
+		}
+		if err := json.Unmarshal(reply, &resp); err != nil {
+			t.Fatalf("Unmarshal: unexpected error: %v", err)
+		}
+		if resp.Error == nil || resp.Error.Code != test.code {
+			t.Errorf("%s: got reply %s, want code %d", test.method,
+				reply, test.code)
+		}
+	}
+
+	err := registry.validateHandlers()
+	if err == nil || !strings.Contains(err.Error(), `"testnohandler"`) ||
+		!strings.Contains(err.Error(), `"testnilhandler"`) ||
+		!strings.Contains(err.Error(), `"testniladded"`) ||
+		strings.Contains(err.Error(), `"testunimplemented"`) {
+
+		t.Errorf("validateHandlers: unexpected error %v", err)
+	}
+	rs, err := NewRpcServer(&RpcServerConfig{
+		Registry:       registry,
+		ListenAddrs:    []string{"127.0.0.1:0"},
+		StrictRegistry: true,
+	})
+	if err != nil {
+		t.Fatalf("NewRpcServer: unexpected error: %v", err)
+	}
+	defer rs.Stop()
+	if err := rs.Start(); err == nil {
+		t.Error("Start: expected error for the command without handler")
+	}
+}
+
+// TestErrorMapping ensures errors are converted to the documented JSON-RPC
+// error codes.
+func TestErrorMapping(t *testing.T) {
+	syntaxErr := json.Unmarshal([]byte("{"), new(interface{}))
+	custom := &RPCError{Code: -1, Message: "custom"}
+	tests := []struct {
+		err  error
+		code RPCErrorCode
+		msg  string
+	}{
+		{custom, -1, "custom"},
+		{*custom, -1, "custom"},
+		{makeError(ErrUnregisteredMethod, "x"), ErrRPCMethodNotFound.Code,
+			ErrRPCMethodNotFound.Message},
+		{makeError(ErrNumParams, "wrong number of params"),
+			ErrRPCInvalidParams.Code, "wrong number of params"},
+		{makeError(ErrInvalidType, "bad type"),
+			ErrRPCInvalidParams.Code, "bad type"},
+		{makeError(ErrDuplicateMethod, "dup"), ErrRPCInternal.Code, "dup"},
+		{syntaxErr, ErrRPCParse.Code, ""},
+		{errors.New("other"), ErrRPCInternal.Code, "other"},
+	}
+	for _, test := range tests {
+		rpcErr := toRPCError(test.err)
+		if rpcErr.Code != test.code ||
+			!strings.Contains(rpcErr.Message, test.msg) {
+
+			t.Errorf("%v: got %v, want code %d", test.err, rpcErr,
+				test.code)
+		}
+	}
+
+	_, addr := newTestServer(t, &RpcServerConfig{})
+	reply := postJSON(t, addr, `{"jsonrpc":"2.0","method":"getreadme","params":[1],"id":1}`)
+	var resp struct {
+		Error *RPCError `json:"error"`
+	}
+	if err := json.Unmarshal(reply, &resp); err != nil {
+		t.Fatalf("Unmarshal: unexpected error: %v", err)
+	}
+	if resp.Error == nil || resp.Error.Code != ErrRPCInvalidParams.Code {
+		t.Errorf("got reply %s, want invalid params error", reply)
+	}
+
+	// Only bytes that are not JSON are parse errors, the reply echoes the
+	// version and id of the request whenever they can be decoded.
+	invalidTests := []struct {
+		body    string
+		code    RPCErrorCode
+		jsonrpc string
+		id      string
+	}{
+		{`{"jsonrpc":"2.0","method"`, ErrRPCParse.Code, "", "null"},
+		{`"foo"`, ErrRPCInvalidRequest.Code, "", "null"},
+		{`{"jsonrpc":"2.0","method":1,"id":1}`, ErrRPCInvalidRequest.Code,
+			`"2.0"`, "1"},
+		{`{"jsonrpc":"2.0","method":"getreadme","params":5,"id":"a"}`,
+			ErrRPCInvalidRequest.Code, `"2.0"`, `"a"`},
+		{`{"jsonrpc":"1.0","method":1,"id":12345678901234567890}`,
+			ErrRPCInvalidRequest.Code, "", "12345678901234567890"},
+		{`[{"jsonrpc":"2.0","method":1,"id":7}]`,
+			ErrRPCInvalidRequest.Code, `"2.0"`, "7"},
+		{`{"jsonrpc":"2.0","id":1}`, ErrRPCInvalidRequest.Code,
+			`"2.0"`, "1"},
+		{`{"jsonrpc":"2.0","method":"","id":1}`,
+			ErrRPCInvalidRequest.Code, `"2.0"`, "1"},
+		{`{"jsonrpc":"2.0","method":"getreadme","params":[],"id":{"a":1}}`,
+			ErrRPCInvalidRequest.Code, `"2.0"`, "null"},
+		{`{"jsonrpc":"2.0","method":"getreadme","params":[],"id":[1]}`,
+			ErrRPCInvalidRequest.Code, `"2.0"`, "null"},
+		{`{"jsonrpc":"2.0","method":"getreadme","params":[],"id":true}`,
+			ErrRPCInvalidRequest.Code, `"2.0"`, "null"},
+		{`{"jsonrpc":"3.0","method":"getreadme","params":[],"id":1}`,
+			ErrRPCInvalidRequest.Code, "", "1"},
+		{`[{"jsonrpc":"2.0","id":7}]`,
+			ErrRPCInvalidRequest.Code, `"2.0"`, "7"},
+		{`[{"jsonrpc":"2.0","method":"getreadme","params":[],"id":{}}]`,
+			ErrRPCInvalidRequest.Code, `"2.0"`, "null"},
+	}
+	for _, test := range invalidTests {
+		reply := postJSON(t, addr, test.body)
+		if strings.HasPrefix(test.body, "[") {
+			var replies []json.RawMessage
+			if err := json.Unmarshal(reply, &replies); err != nil ||
+				len(replies) != 1 {
+
+				t.Errorf("%s: got reply %s", test.body, reply)
+				continue
+			}
+			reply = replies[0]
+		}
+		var resp struct {
+			Jsonrpc json.RawMessage `json:"jsonrpc"`
+			ID      json.RawMessage `json:"id"`
+			Error   *RPCError       `json:"error"`
+		}
+		if err := json.Unmarshal(reply, &resp); err != nil {
+			t.Fatalf("Unmarshal: unexpected error: %v", err)
+		}
+		if resp.Error == nil || resp.Error.Code != test.code ||
+			string(resp.Jsonrpc) != test.jsonrpc ||
+			string(resp.ID) != test.id {
+
+			t.Errorf("%s: got reply %s, want code %d, jsonrpc %s "+
+				"and id %s", test.body, reply, test.code,
+				test.jsonrpc, test.id)
+		}
+	}
+}
+
+// TestErrorData ensures invalid params errors carry details about the
+// offending parameter and the data survives a round trip.
+func TestErrorData(t *testing.T) {
+	_, addr := newTestServer(t, &RpcServerConfig{})
+	tests := []struct {
+		body string
+		want ParamErrorData
+	}{
+		{`{"jsonrpc":"2.0","method":"getreadme","params":[1],"id":1}`,
+			ParamErrorData{Expected: "0", Got: "1", Rule: "count"}},
+		{`{"jsonrpc":"2.0","method":"getreadme","params":{"x":1},"id":1}`,
+			ParamErrorData{Name: "x", Rule: "unknown"}},
+	}
+	for _, test := range tests {
+		reply := postJSON(t, addr, test.body)
+		var resp struct {
+			Error *RPCError `json:"error"`
+		}
+		if err := json.Unmarshal(reply, &resp); err != nil {
+			t.Fatalf("Unmarshal: unexpected error: %v", err)
+		}
+		if resp.Error == nil {
+			t.Errorf("%s: got reply %s, want error", test.body, reply)
+			continue
+		}
+		var data ParamErrorData
+		if err := resp.Error.DecodeData(&data); err != nil {
+			t.Errorf("%s: DecodeData: unexpected error: %v",
+				test.body, err)
+			continue
+		}
+		if data != test.want {
+			t.Errorf("%s: got data %+v, want %+v", test.body, data,
+				test.want)
+		}
+	}
+
+	// Errors without data marshal without the data field.
+	b, err := json.Marshal(ErrRPCInternal)
+	if err != nil {
+		t.Fatalf("Marshal: unexpected error: %v", err)
+	}
+	var rpcErr RPCError
+	if err := json.Unmarshal(b, &rpcErr); err != nil {
+		t.Fatalf("Unmarshal: unexpected error: %v", err)
+	}
+	if strings.Contains(string(b), "data") || rpcErr.Data != nil {
+		t.Errorf("got %s, want no data", b)
+	}
+	if err := rpcErr.DecodeData(new(ParamErrorData)); err == nil {
+		t.Error("DecodeData: expected error for missing data")
+	}
+	if ErrRPCInvalidParams.WithData(1).Data == ErrRPCInvalidParams.Data {
+		t.Error("WithData modified the predefined error")
+	}
+}
@@ -1,7 +1,10 @@
 package gorpc
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
+	"time"
 )
 
 // RPCErrorCode represents an error code to be used as a part of an RPCError
@@ -11,10 +14,125 @@ import (
 type RPCErrorCode int
 
 // RPCError represents an error that is used as a part of a JSON-RPC Response
-// object.
+// object.  Data optionally holds structured details about the error, such as
+// a ParamErrorData or RetryErrorData.  When an RPCError is unmarshalled the
+// data is kept as a json.RawMessage, use DecodeData to decode it.
+//
+// RPCError values can not be compared with ==, since their data may not be
+// comparable.  Use errors.Is, which matches errors by their code.
 type RPCError struct {
 	Code    RPCErrorCode `json:"code,omitempty"`
 	Message string       `json:"message,omitempty"`
+	Data    interface{}  `json:"data,omitempty"`
+
+	// noCompare makes RPCError not comparable, so errors.Is never
+	// compares two values with == and uses the Is method instead.
+	noCompare [0]func()
+}
+
+// NewRPCError constructs and returns a new JSON-RPC error that is suitable
+// for use in a JSON-RPC Response object.
+func NewRPCError(code RPCErrorCode, message string) *RPCError {
+	return &RPCError{
+		Code:    code,
+		Message: message,
+	}
+}
+
+// NewRPCErrorWithData constructs and returns a new JSON-RPC error carrying
+// the passed structured details.
+func NewRPCErrorWithData(code RPCErrorCode, message string, data interface{}) *RPCError {
+	return &RPCError{
+		Code:    code,
+		Message: message,
+		Data:    data,
+	}
+}
+
+// WithData returns a copy of the error carrying the passed structured
+// details, so the predefined errors can be returned with details, for example
+// ErrRPCInvalidParams.WithData(&ParamErrorData{Name: "amount"}).
+func (e *RPCError) WithData(data interface{}) *RPCError {
+	errCopy := *e
+	errCopy.Data = data
+	return &errCopy
+}
+
+// UnmarshalJSON unmarshals an error, keeping its data as a json.RawMessage.
+func (e *RPCError) UnmarshalJSON(b []byte) error {
+	var raw struct {
+		Code    RPCErrorCode    `json:"code"`
+		Message string          `json:"message"`
+		Data    json.RawMessage `json:"data"`
+	}
+	if err := json.Unmarshal(b, &raw); err != nil {
+		return err
+	}
+	e.Code = raw.Code
+	e.Message = raw.Message
+	e.Data = nil
+	if len(raw.Data) != 0 && string(raw.Data) != "null" {
+		e.Data = raw.Data
+	}
+	return nil
+}
+
+// DecodeData decodes the structured details of the error into the value
+// pointed to by v.  It returns an error when the error carries no data.
+func (e *RPCError) DecodeData(v interface{}) error {
+	switch data := e.Data.(type) {
+	case nil:
+		return errors.New("error has no data")
+	case json.RawMessage:
+		return json.Unmarshal(data, v)
+	default:
+		b, err := json.Marshal(data)
+		if err != nil {
+			return err
+		}
+		return json.Unmarshal(b, v)
+	}
+}
+
+// ParamErrorData is the data of ErrRPCInvalidParams errors describing the
+// offending parameter.
+type ParamErrorData struct {
+	// Index is the 1-based position of the parameter for positional
+	// params and zero for named params.
+	Index int `json:"index,omitempty"`
+
+	// Name is the name of the parameter.
+	Name string `json:"name,omitempty"`
+
+	// Expected and Got describe the expected and the received type, or
+	// number of parameters.
+	Expected string `json:"expected,omitempty"`
+	Got      string `json:"got,omitempty"`
+
+	// Rule is the validation rule the parameter violated, one of "type",
+	// "required", "unknown", "duplicate" or "count".
+	Rule string `json:"rule,omitempty"`
+}
+
+// NewInvalidParamError returns an ErrRPCInvalidParams error with the passed
+// message and details about the offending parameter.
+func NewInvalidParamError(message string, data *ParamErrorData) *RPCError {
+	return NewRPCErrorWithData(ErrRPCInvalidParams.Code, message, data)
+}
+
+// RetryErrorData is the data of errors about requests that may succeed when
+// retried later, such as ErrRPCRateLimited.
+type RetryErrorData struct {
+	// RetryAfter is the number of seconds to wait before retrying.
+	RetryAfter float64 `json:"retryAfter"`
+}
+
+// NewRetryError returns an error with the passed code and message hinting
+// the client to retry after the passed duration.
+func NewRetryError(code RPCErrorCode, message string, retryAfter time.Duration) *RPCError {
+	return NewRPCErrorWithData(code, message, &RetryErrorData{
+		RetryAfter: retryAfter.Seconds(),
+	})
 }
 
 // Standard JSON-RPC 2.0 errors.
@@ -41,6 +159,55 @@ var (
 	}
 )
 
+// Server errors.  The JSON-RPC 2.0 spec reserves the codes from -32000 to
+// -32099 for implementation-defined server errors.
+var (
+	ErrRPCUnauthorized = &RPCError{
+		Code:    -32001,
+		Message: "Unauthorized",
+	}
+	ErrRPCRateLimited = &RPCError{
+		Code:    -32002,
+		Message: "Rate limit exceeded",
+	}
+	ErrRPCTimeout = &RPCError{
+		Code:    -32003,
+		Message: "Request timed out",
+	}
+	ErrRPCUnimplemented = &RPCError{
+		Code:    -32004,
+		Message: "Command unimplemented",
+	}
+)
+
 func (e RPCError) Error() string {
 	return fmt.Sprintf("%d:%s", e.Code, e.Message)
 }
+
+// Is reports whether the target is an RPCError with the same code, so
+// errors.Is(err, ErrRPCTimeout) matches every timeout error regardless of its
+// message and data.
+func (e RPCError) Is(target error) bool {
+	switch t := target.(type) {
+	case *RPCError:
+		return t != nil && t.Code == e.Code
+	case RPCError:
+		return t.Code == e.Code
+	}
+	return false
+}
+
+// As lets errors.As find an RPCError value with a *RPCError target and the
+// other way round.
+func (e RPCError) As(target interface{}) bool {
+	switch t := target.(type) {
+	case **RPCError:
+		errCopy := e
+		*t = &errCopy
+		return true
+	case *RPCError:
+		*t = e
+		return true
+	}
+	return false
+}
@@ -4,8 +4,10 @@ import (
 	"encoding/json"
 	"fmt"
 	"reflect"
+	"sort"
 	"strings"
 	"sync"
+	"time"
 )
 
 // UsageFlag define flags that specify additional properties about the
@@ -42,34 +44,415 @@ type methodInfo struct {
 	defaults     map[int]reflect.Value
 	flags        UsageFlag
 	usage        string
+
+	// roles restricts the method to principals having at least one of
+	// them.  An empty list allows everyone.
+	roles []string
+
+	// maxConcurrent is the maximum number of handlers of the method that
+	// may run concurrently, zero means no limit.
+	maxConcurrent int
+
+	// timeout is the maximum time a handler of the method may run, zero
+	// means the HandlerTimeout of the server applies.
+	timeout time.Duration
+
+	// resultType is the type of the result of methods registered with a
+	// typed handler, nil for all others.
+	resultType reflect.Type
+}
+
+// RegisterOption configures optional properties of a method at registration
+// time.
+type RegisterOption func(*methodInfo)
+
+// WithRoles restricts a method to principals having at least one of the
+// passed roles, or RoleAdmin.  Calls from other principals, including
+// unauthenticated clients, are rejected with ErrRPCUnauthorized.
+func WithRoles(roles ...string) RegisterOption {
+	return func(info *methodInfo) {
+		info.roles = append(info.roles, roles...)
+	}
+}
+
+// WithMaxConcurrent limits how many handlers of a method may run concurrently.
+// Further calls are rejected with ErrRPCRateLimited until one of the running
+// handlers finished.
+func WithMaxConcurrent(n int) RegisterOption {
+	return func(info *methodInfo) {
+		info.maxConcurrent = n
+	}
+}
+
+// WithTimeout limits how long a handler of a method may run, overriding the
+// HandlerTimeout of the server.  Once it expires the context of the handler is
+// cancelled and the client receives ErrRPCTimeout.
+func WithTimeout(timeout time.Duration) RegisterOption {
+	return func(info *methodInfo) {
+		info.timeout = timeout
+	}
+}
+
+// Registry holds a set of commands along with their handlers.  Every RpcServer
+// serves the commands of a single registry, see RpcServerConfig.Registry, so
+// servers in the same process can expose different methods.  The
+// package-level Register functions use the default registry, which servers
+// without a registry of their own serve.
+//
+// A registry is safe for concurrent use, so methods may be registered and
+// unregistered while servers are running.  Their websocket clients are
+// notified of every change with a methodschanged notification.
+type Registry struct {
+	mtx                  sync.RWMutex
+	methodToConcreteType map[string]reflect.Type
+	methodToInfo         map[string]methodInfo
+	concreteTypeToMethod map[reflect.Type]string
+
+	// rpcHandlers and wsHandlers hold the handlers of the commands
+	// available over HTTP and websockets and the commands available over
+	// websockets only.
+	rpcHandlers map[string]ContextHandler
+	wsHandlers  map[string]WsContextHandler
+
+	// unimplemented holds the commands that are registered, so clients can
+	// marshal them, but not implemented by this server.
+	unimplemented map[string]struct{}
+
+	// servers holds the servers serving the registry which have not been
+	// stopped yet.  They are notified when its methods change.
+	servers map[*RpcServer]struct{}
+}
+
+// NewRegistry returns an empty registry.  Use RegisterBuiltins to add the
+// commands the default registry comes with, such as getreadme.
+func NewRegistry() *Registry {
+	return &Registry{
+		methodToConcreteType: make(map[string]reflect.Type),
+		methodToInfo:         make(map[string]methodInfo),
+		concreteTypeToMethod: make(map[reflect.Type]string),
+		rpcHandlers:          make(map[string]ContextHandler),
+		wsHandlers:           make(map[string]WsContextHandler),
+		unimplemented:        make(map[string]struct{}),
+		servers:              make(map[*RpcServer]struct{}),
+	}
+}
+
+// defaultRegistry is the registry used by the package-level functions.
+var defaultRegistry = NewRegistry()
+
+// DefaultRegistry returns the registry the package-level Register functions
+// add to, which is served by servers without a registry of their own.
+func DefaultRegistry() *Registry {
+	return defaultRegistry
+}
+
+// Clone returns a copy of the registry, so commands can be added to either one
+// without affecting the other.
+func (r *Registry) Clone() *Registry {
+	clone := NewRegistry()
+	r.mtx.RLock()
+	defer r.mtx.RUnlock()
+	for method, rtp := range r.methodToConcreteType {
+		clone.methodToConcreteType[method] = rtp
+	}
+	for method, info := range r.methodToInfo {
+		clone.methodToInfo[method] = info
+	}
+	for rtp, method := range r.concreteTypeToMethod {
+		clone.concreteTypeToMethod[rtp] = method
+	}
+	for method, handler := range r.rpcHandlers {
+		clone.rpcHandlers[method] = handler
+	}
+	for method, handler := range r.wsHandlers {
+		clone.wsHandlers[method] = handler
+	}
+	for method := range r.unimplemented {
+		clone.unimplemented[method] = struct{}{}
+	}
+	return clone
+}
+
+// Merge adds the commands and handlers of the passed registries to r.  It
+// fails with ErrDuplicateMethod, without changing r, when a method or command
+// type is registered more than once.
+func (r *Registry) Merge(others ...*Registry) error {
+	// Copy the others first, so no two registries are locked at once.
+	clones := make([]*Registry, 0, len(others))
+	for _, other := range others {
+		clones = append(clones, other.Clone())
+	}
+
+	r.mtx.Lock()
+	methods := r.allMethods()
+	types := make(map[reflect.Type]struct{})
+	for rtp := range r.concreteTypeToMethod {
+		types[rtp] = struct{}{}
+	}
+	for _, clone := range clones {
+		for method := range clone.allMethods() {
+			if _, ok := methods[method]; ok {
+				r.mtx.Unlock()
+				str := fmt.Sprintf("method %q is already "+
+					"registered", method)
+				return makeError(ErrDuplicateMethod, str)
+			}
+			methods[method] = struct{}{}
+		}
+		for rtp, method := range clone.concreteTypeToMethod {
+			if _, ok := types[rtp]; ok {
+				r.mtx.Unlock()
+				str := fmt.Sprintf("type %v of method %q is "+
+					"already registered", rtp, method)
+				return makeError(ErrDuplicateMethod, str)
+			}
+			types[rtp] = struct{}{}
+		}
+	}
+
+	for _, clone := range clones {
+		for method, rtp := range clone.methodToConcreteType {
+			r.methodToConcreteType[method] = rtp
+		}
+		for method, info := range clone.methodToInfo {
+			r.methodToInfo[method] = info
+		}
+		for rtp, method := range clone.concreteTypeToMethod {
+			r.concreteTypeToMethod[rtp] = method
+		}
+		for method, handler := range clone.rpcHandlers {
+			r.rpcHandlers[method] = handler
+		}
+		for method, handler := range clone.wsHandlers {
+			r.wsHandlers[method] = handler
+		}
+		for method := range clone.unimplemented {
+			r.unimplemented[method] = struct{}{}
+		}
+	}
+
+	// Methods without a handler are announced once one is added.
+	var added []string
+	for _, clone := range clones {
+		for method := range clone.allMethods() {
+			if r.callable(method) {
+				added = append(added, method)
+			}
+		}
+	}
+	servers := r.serverList()
+	r.mtx.Unlock()
+
+	notifyMethodsChanged(servers, added, nil)
+	return nil
+}
+
+// ComposeRegistries returns a new registry holding the commands and handlers
+// of all passed registries, for example to serve the methods of a public and
+// an admin API from one server.  See Merge for the errors it returns.
+func ComposeRegistries(registries ...*Registry) (*Registry, error) {
+	r := NewRegistry()
+	if err := r.Merge(registries...); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// allMethods returns the methods that have a command, a handler or are marked
+// as unimplemented.  It must be called with the mutex held.
+func (r *Registry) allMethods() map[string]struct{} {
+	methods := r.handlerMethods()
+	for method := range r.methodToConcreteType {
+		methods[method] = struct{}{}
+	}
+	for method := range r.unimplemented {
+		methods[method] = struct{}{}
+	}
+	return methods
+}
+
+// Methods returns the registered methods in sorted order.
+func (r *Registry) Methods() []string {
+	r.mtx.RLock()
+	methods := make([]string, 0, len(r.methodToConcreteType))
+	for method := range r.methodToConcreteType {
+		methods = append(methods, method)
+	}
+	r.mtx.RUnlock()
+	sort.Strings(methods)
+	return methods
 }
 
-var registerLock sync.RWMutex
-var methodToConcreteType = make(map[string]reflect.Type)
-var methodToInfo = make(map[string]methodInfo)
-var concreteTypeToMethod = make(map[reflect.Type]string)
 // 提供给外部注册的方法
-func Register(method string, cmd interface{},handler commandHandler,flags UsageFlag){
-	AddRpcHandler(method,handler)
-	MustRegisterCmd(method,cmd,flags)
+func Register(method string, cmd interface{}, handler commandHandler, flags UsageFlag, opts ...RegisterOption) {
+	defaultRegistry.Register(method, cmd, handler, flags, opts...)
+}
+
+// Register adds the command and its handler to the registry at once.  It
+// panics if the command cannot be registered, see MustRegisterCmd.
+func (r *Registry) Register(method string, cmd interface{}, handler commandHandler, flags UsageFlag, opts ...RegisterOption) {
+	r.mustRegister(method, cmd, flags, opts, adaptHandler(handler), nil)
+}
+
+// RegisterContext 和Register一样，只是handler接收一个context.Context，
+// 客户端断开、服务器关闭或者超时的时候context会被取消，
+// 并且可以通过RequestInfoFromContext拿到请求的信息
+func RegisterContext(method string, cmd interface{}, handler ContextHandler, flags UsageFlag, opts ...RegisterOption) {
+	defaultRegistry.RegisterContext(method, cmd, handler, flags, opts...)
+}
+
+// RegisterContext is like Register for handlers receiving a context.Context.
+func (r *Registry) RegisterContext(method string, cmd interface{}, handler ContextHandler, flags UsageFlag, opts ...RegisterOption) {
+	r.mustRegister(method, cmd, flags, opts, handler, nil)
+}
+
+// RegisterWs 注册只能通过websocket调用的方法，handler可以拿到调用它的WsClient，
+// 从而为这个客户端订阅通知
+func RegisterWs(method string, cmd interface{}, handler wsCommandHandler, flags UsageFlag, opts ...RegisterOption) {
+	defaultRegistry.RegisterWs(method, cmd, handler, flags, opts...)
+}
+
+// RegisterWs is like Register for commands that can only be used over
+// websockets.
+func (r *Registry) RegisterWs(method string, cmd interface{}, handler wsCommandHandler, flags UsageFlag, opts ...RegisterOption) {
+	r.mustRegister(method, cmd, flags|UFWebsocketOnly, opts, nil,
+		adaptWsHandler(handler))
+}
+
+// RegisterWsContext 和RegisterWs一样，只是handler接收一个context.Context，
+// 可以通过RequestInfoFromContext拿到请求的信息
+func RegisterWsContext(method string, cmd interface{}, handler WsContextHandler, flags UsageFlag, opts ...RegisterOption) {
+	defaultRegistry.RegisterWsContext(method, cmd, handler, flags, opts...)
+}
+
+// RegisterWsContext is like RegisterWs for handlers receiving a
+// context.Context.
+func (r *Registry) RegisterWsContext(method string, cmd interface{}, handler WsContextHandler, flags UsageFlag, opts ...RegisterOption) {
+	r.mustRegister(method, cmd, flags|UFWebsocketOnly, opts, nil, handler)
+}
+
+// mustRegister performs the same function as register except it panics if
+// there is an error.
+func (r *Registry) mustRegister(method string, cmd interface{}, flags UsageFlag, opts []RegisterOption, handler ContextHandler, wsHandler WsContextHandler) {
+	err := r.register(method, cmd, flags, opts, handler, wsHandler)
+	if err != nil {
+		panic(fmt.Sprintf("failed to register type %q:%v\n", method, err))
+	}
+}
+
+// register registers the command along with its handlers, so no request sees
+// one without the other, and notifies the servers of the new method once it
+// can be called.  Nil handlers are not stored, so calling the method returns
+// ErrRPCMethodNotFound and validateHandlers reports it.
+func (r *Registry) register(method string, cmd interface{}, flags UsageFlag, opts []RegisterOption, handler ContextHandler, wsHandler WsContextHandler) error {
+	return r.updateMethod(method, func() error {
+		if err := r.registerCmd(method, cmd, flags, opts...); err != nil {
+			return err
+		}
+		if handler != nil {
+			r.rpcHandlers[method] = handler
+		}
+		if wsHandler != nil {
+			r.wsHandlers[method] = wsHandler
+		}
+		return nil
+	})
+}
+
+// Unregister removes the method from the default registry, see
+// Registry.Unregister.
+func Unregister(method string) error {
+	return defaultRegistry.Unregister(method)
+}
+
+// Unregister removes the command of the passed method along with its handlers
+// from the registry at once and notifies the websocket clients of the servers
+// serving the registry.  Requests already running the handler are not
+// affected.
+func (r *Registry) Unregister(method string) error {
+	r.mtx.Lock()
+	if _, ok := r.allMethods()[method]; !ok {
+		r.mtx.Unlock()
+		str := fmt.Sprintf("%q is not registered", method)
+		return makeError(ErrUnregisteredMethod, str)
+	}
+	if rtp, ok := r.methodToConcreteType[method]; ok {
+		delete(r.concreteTypeToMethod, rtp)
+	}
+	delete(r.methodToConcreteType, method)
+	delete(r.methodToInfo, method)
+	delete(r.rpcHandlers, method)
+	delete(r.wsHandlers, method)
+	delete(r.unimplemented, method)
+	servers := r.serverList()
+	r.mtx.Unlock()
+
+	notifyMethodsChanged(servers, nil, []string{method})
+	return nil
+}
+
+// addServer adds a server to notify when the methods change.
+func (r *Registry) addServer(rs *RpcServer) {
+	r.mtx.Lock()
+	r.servers[rs] = struct{}{}
+	r.mtx.Unlock()
+}
+
+// removeServer removes a server added with addServer.
+func (r *Registry) removeServer(rs *RpcServer) {
+	r.mtx.Lock()
+	delete(r.servers, rs)
+	r.mtx.Unlock()
+}
+
+// serverList returns the servers to notify when the methods change.  It must
+// be called with the mutex held, the servers must be notified once it is
+// released.
+func (r *Registry) serverList() []*RpcServer {
+	servers := make([]*RpcServer, 0, len(r.servers))
+	for rs := range r.servers {
+		servers = append(servers, rs)
+	}
+	return servers
 }
 
 // MustRegisterCmd performs the same function as RegisterCmd except it panics
 // if there is an error.  This should only be called from package init
 // functions.
-func MustRegisterCmd(method string, cmd interface{}, flags UsageFlag) {
-	if err := RegisterCmd(method, cmd, flags); err != nil {
+func MustRegisterCmd(method string, cmd interface{}, flags UsageFlag, opts ...RegisterOption) {
+	defaultRegistry.MustRegisterCmd(method, cmd, flags, opts...)
+}
+
+// MustRegisterCmd performs the same function as RegisterCmd except it panics
+// if there is an error.
+func (r *Registry) MustRegisterCmd(method string, cmd interface{}, flags UsageFlag, opts ...RegisterOption) {
+	if err := r.RegisterCmd(method, cmd, flags, opts...); err != nil {
 		panic(fmt.Sprintf("failed to register type %q:%v\n", method, err))
 	}
 }
 
+// RegisterCmd registers a command in the default registry, see
+// Registry.RegisterCmd.
+func RegisterCmd(method string, cmd interface{}, flags UsageFlag, opts ...RegisterOption) error {
+	return defaultRegistry.RegisterCmd(method, cmd, flags, opts...)
+}
+
+// RegisterCmd registers a new command that will automatically marshal to and
+// from JSON-RPC with full type checking and positional parameter support.  The
+// servers serving the registry are notified of the new method once it can be
+// called, which is when a handler is added for it.
+func (r *Registry) RegisterCmd(method string, cmd interface{}, flags UsageFlag, opts ...RegisterOption) error {
+	return r.updateMethod(method, func() error {
+		return r.registerCmd(method, cmd, flags, opts...)
+	})
+}
+
 // TODO 这里用反射的目的到底是什么？是要预防什么情况吗？
 // 这个方法会设置map，methodToInfo和methodToConcreteType和concreteTypeToMethod
-func RegisterCmd(method string, cmd interface{}, flags UsageFlag) error {
-	registerLock.Lock()
-	defer registerLock.Unlock()
+// It must be called with the mutex held.
+func (r *Registry) registerCmd(method string, cmd interface{}, flags UsageFlag, opts ...RegisterOption) error {
 	// method是否已经注册
-	if _, ok := methodToConcreteType[method]; ok {
+	if _, ok := r.methodToConcreteType[method]; ok {
 		str := fmt.Sprintf("method %q is already registered", method)
 		return makeError(ErrDuplicateMethod, str)
 	}
@@ -184,15 +567,19 @@ func RegisterCmd(method string, cmd interface{}, flags UsageFlag) error {
 	}
 
 	// Update the registration maps.
-	methodToConcreteType[method] = rtp
-	methodToInfo[method] = methodInfo{
+	r.methodToConcreteType[method] = rtp
+	info := methodInfo{
 		maxParams:    numFields,
 		numReqParams: numFields - numOptFields,
 		numOptParams: numOptFields,
 		defaults:     defaults,
 		flags:        flags,
 	}
-	concreteTypeToMethod[rtp] = method
+	for _, opt := range opts {
+		opt(&info)
+	}
+	r.methodToInfo[method] = info
+	r.concreteTypeToMethod[rtp] = method
 	return nil
 }
 
@@ -230,3 +617,71 @@ func isAcceptableKind(kind reflect.Kind) bool {
 	return true
 }
 
+// CmdMethod returns the method for the passed command.  The provided command
+// type must be a registered type.  All commands provided by this package are
+// registered by default.
+func CmdMethod(cmd interface{}) (string, error) {
+	return defaultRegistry.CmdMethod(cmd)
+}
+
+// CmdMethod returns the method for the passed command, which must be
+// registered in the registry.
+func (r *Registry) CmdMethod(cmd interface{}) (string, error) {
+	// Look up the cmd type and error out if not registered.
+	rt := reflect.TypeOf(cmd)
+	r.mtx.RLock()
+	method, ok := r.concreteTypeToMethod[rt]
+	r.mtx.RUnlock()
+	if !ok {
+		str := fmt.Sprintf("type %v is not registered", rt)
+		return "", makeError(ErrUnregisteredMethod, str)
+	}
+
+	return method, nil
+}
+
+// MethodUsageFlags returns the usage flags for the passed command method.  The
+// provided method must be associated with a registered type.  All commands
+// provided by this package are registered by default.
+func MethodUsageFlags(method string) (UsageFlag, error) {
+	return defaultRegistry.MethodUsageFlags(method)
+}
+
+// MethodUsageFlags returns the usage flags for the passed command method,
+// which must be registered in the registry.
+func (r *Registry) MethodUsageFlags(method string) (UsageFlag, error) {
+	// Look up details about the provided method and error out if not
+	// registered.
+	r.mtx.RLock()
+	info, ok := r.methodToInfo[method]
+	r.mtx.RUnlock()
+	if !ok {
+		str := fmt.Sprintf("%q is not registered", method)
+		return 0, makeError(ErrUnregisteredMethod, str)
+	}
+
+	return info.flags, nil
+}
+
+// methodRoles returns the roles the passed method is restricted to.
+func (r *Registry) methodRoles(method string) []string {
+	r.mtx.RLock()
+	defer r.mtx.RUnlock()
+	return r.methodToInfo[method].roles
+}
+
+// methodMaxConcurrent returns the concurrency cap of the passed method, zero
+// if it has none.
+func (r *Registry) methodMaxConcurrent(method string) int {
+	r.mtx.RLock()
+	defer r.mtx.RUnlock()
+	return r.methodToInfo[method].maxConcurrent
+}
+
+// methodTimeout returns the timeout the passed method was registered with,
+// zero if it has none.
+func (r *Registry) methodTimeout(method string) time.Duration {
+	r.mtx.RLock()
+	defer r.mtx.RUnlock()
+	return r.methodToInfo[method].timeout
+}
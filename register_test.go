@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"reflect"
+	"strings"
 	"testing"
 )
 
@@ -108,3 +109,163 @@ func TesRegisteCmd(method string, cmd interface{}) {
 	// 下面的是comParse中UnmarshalCmd方法的测试
 
 }
+
+// namedParamsCmd is used by TestUnmarshalNamedParams.
+type namedParamsCmd struct {
+	Account string  `json:"account"`
+	Amount  float64 `json:"amount"`
+	MinConf *int    `json:"minconf" jsonrpcdefault:"1"`
+	Comment *string
+	Ignored *string `json:"-"`
+}
+
+// TestUnmarshalNamedParams ensures params given as an object are matched to
+// the command fields by name.
+func TestUnmarshalNamedParams(t *testing.T) {
+	registry := newTestRegistry(t)
+	registry.MustRegisterCmd("testnamedparams", (*namedParamsCmd)(nil), 0)
+
+	tests := []struct {
+		name string
+		body string
+		want *namedParamsCmd
+		code ErrorCode
+	}{
+		{
+			name: "json tags and defaults",
+			body: `{"params":{"account":"a","amount":1.5}}`,
+			want: &namedParamsCmd{Account: "a", Amount: 1.5,
+				MinConf: intPtr(1)},
+		},
+		{
+			name: "case-insensitive",
+			body: `{"params":{"ACCOUNT":"a","Amount":2,"comment":"c","minconf":6}}`,
+			want: &namedParamsCmd{Account: "a", Amount: 2,
+				MinConf: intPtr(6), Comment: strPtr("c")},
+		},
+		{
+			name: "unknown key",
+			body: `{"params":{"account":"a","amount":1,"foo":1}}`,
+			code: ErrUnknownParam,
+		},
+		{
+			name: "missing required",
+			body: `{"params":{"account":"a"}}`,
+			code: ErrMissingParam,
+		},
+		{
+			name: "wrong type",
+			body: `{"params":{"account":"a","amount":"1"}}`,
+			code: ErrInvalidType,
+		},
+		{
+			name: "duplicate key",
+			body: `{"params":{"account":"a","ACCOUNT":"b","amount":1}}`,
+			code: ErrDuplicateParam,
+		},
+		{
+			name: "ignored field",
+			body: `{"params":{"account":"a","amount":1,"Ignored":"x"}}`,
+			code: ErrUnknownParam,
+		},
+	}
+
+	for _, test := range tests {
+		var request Request
+		if err := json.Unmarshal([]byte(test.body), &request); err != nil {
+			t.Fatalf("%s: Unmarshal: unexpected error: %v", test.name, err)
+		}
+		request.Method = "testnamedparams"
+		cmd, err := registry.UnmarshalCmd(&request)
+		if test.want == nil {
+			gerr, ok := err.(Error)
+			if !ok || gerr.ErrorCode != test.code {
+				t.Errorf("%s: got error %v, want %v", test.name,
+					err, test.code)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", test.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(cmd, test.want) {
+			t.Errorf("%s: got %+v, want %+v", test.name, cmd, test.want)
+		}
+	}
+
+	var request Request
+	if err := json.Unmarshal([]byte(`{"params":1}`), &request); err == nil {
+		t.Error("Unmarshal: expected error for scalar params")
+	}
+}
+
+func intPtr(i int) *int       { return &i }
+func strPtr(s string) *string { return &s }
+
+// registryCmd is used by TestRegistry.
+type registryCmd struct{}
+
+// TestRegistry ensures servers only serve the methods of their own registry
+// and registries can be cloned and composed.
+func TestRegistry(t *testing.T) {
+	handler := func(s *RpcServer, cmd interface{}, closeChan <-chan struct{}) (interface{}, error) {
+		return "admin", nil
+	}
+	admin := NewRegistry()
+	admin.Register("testadmin", (*registryCmd)(nil), handler, 0)
+
+	public := NewRegistry()
+	if err := public.RegisterBuiltins(); err != nil {
+		t.Fatalf("RegisterBuiltins: unexpected error: %v", err)
+	}
+
+	if got := admin.Methods(); !reflect.DeepEqual(got, []string{"testadmin"}) {
+		t.Errorf("Methods: got %v, want [testadmin]", got)
+	}
+	if _, err := CmdMethod((*registryCmd)(nil)); err == nil {
+		t.Error("CmdMethod: command leaked into the default registry")
+	}
+
+	// Clones are independent of the original.
+	clone := admin.Clone()
+	clone.AddUnimplemented("testadmin")
+	if admin.isUnimplemented("testadmin") {
+		t.Error("Clone: change to the clone affected the original")
+	}
+
+	combined, err := ComposeRegistries(public, admin)
+	if err != nil {
+		t.Fatalf("ComposeRegistries: unexpected error: %v", err)
+	}
+	if _, err := ComposeRegistries(admin, clone); err == nil {
+		t.Error("ComposeRegistries: expected error for duplicate method")
+	}
+	if err := public.Merge(public.Clone()); err == nil {
+		t.Error("Merge: expected error for duplicate method")
+	}
+
+	call := func(addr, method string) []byte {
+		return postJSON(t, addr, `{"jsonrpc":"2.0","method":"`+method+
+			`","params":[],"id":1}`)
+	}
+	_, adminAddr := newTestServer(t, &RpcServerConfig{Registry: admin})
+	_, combinedAddr := newTestServer(t, &RpcServerConfig{Registry: combined})
+	tests := []struct {
+		addr   string
+		method string
+		want   string
+	}{
+		{adminAddr, "testadmin", `"result":"admin"`},
+		{adminAddr, "getreadme", `"code":-32601`},
+		{combinedAddr, "testadmin", `"result":"admin"`},
+		{combinedAddr, "getreadme", `"result":{`},
+	}
+	for _, test := range tests {
+		reply := call(test.addr, test.method)
+		if !strings.Contains(string(reply), test.want) {
+			t.Errorf("%s: got reply %s, want %s", test.method, reply,
+				test.want)
+		}
+	}
+}
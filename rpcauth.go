@@ -0,0 +1,215 @@
+package gorpc
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"net/http"
+)
+
+// Roles of the principals created for the users configured with RPCUser and
+// RPCLimitUser.
+const (
+	RoleAdmin   = "admin"
+	RoleLimited = "limited"
+)
+
+// Principal is the authenticated identity a request is made on behalf of.
+type Principal struct {
+	// Name identifies the principal, for example the user name.
+	Name string
+
+	// Roles are used to decide which methods the principal may call.
+	Roles []string
+
+	// Claims holds the claims of the token the principal authenticated
+	// with, if any.
+	Claims map[string]interface{}
+}
+
+// HasRole returns whether the principal has the passed role.  A nil
+// principal, which stands for an unauthenticated client, has no roles.
+func (p *Principal) HasRole(role string) bool {
+	if p == nil {
+		return false
+	}
+	for _, r := range p.Roles {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
+
+// Authenticator maps the credentials of an HTTP request, or of the websocket
+// upgrade request, to a principal.
+type Authenticator interface {
+	// Authenticate returns the principal the request is made on behalf
+	// of.  It returns an error when the request carries invalid
+	// credentials, which rejects the request with 401 Unauthorized.  A nil
+	// principal without an error lets the request through as an
+	// unauthenticated client.
+	Authenticate(r *http.Request) (*Principal, error)
+}
+
+// AuthChallenger is implemented by authenticators that use an HTTP
+// authentication scheme other than Basic.
+type AuthChallenger interface {
+	// Challenge returns the WWW-Authenticate header sent along with the
+	// 401 Unauthorized reply to the passed request.
+	Challenge(r *http.Request) string
+}
+
+// basicAuthChallenge is the WWW-Authenticate header sent to clients rejected
+// by the HTTP Basic authentication of the config.
+const basicAuthChallenge = `Basic realm="gorpc RPC"`
+
+// basicAuthSHA returns the SHA-256 of the Authorization header a client sends
+// for the passed credentials using HTTP Basic authentication.
+func basicAuthSHA(user, pass string) [sha256.Size]byte {
+	login := user + ":" + pass
+	auth := "Basic " + base64.StdEncoding.EncodeToString([]byte(login))
+	return sha256.Sum256([]byte(auth))
+}
+
+// setupAuth computes the credential hashes and the limited user allow-list
+// from the config.
+func (rs *RpcServer) setupAuth() {
+	config := rs.Config
+	if config.RPCUser != "" && config.RPCPass != "" {
+		rs.authsha = basicAuthSHA(config.RPCUser, config.RPCPass)
+		rs.authRequired = true
+	}
+	if config.RPCLimitUser != "" && config.RPCLimitPass != "" {
+		rs.limitauthsha = basicAuthSHA(config.RPCLimitUser,
+			config.RPCLimitPass)
+		rs.authRequired = true
+	}
+	rs.rpcLimited = make(map[string]struct{}, len(config.RPCLimitedMethods))
+	for _, method := range config.RPCLimitedMethods {
+		rs.rpcLimited[method] = struct{}{}
+	}
+}
+
+// checkAuth checks the HTTP Basic authentication supplied by a client in the
+// HTTP request r.  When no credentials are configured every client is
+// treated as an admin.
+//
+// The first bool return value signifies auth success (true if successful) and
+// the second bool return value specifies whether the user can change the state
+// of the server (true) or whether the user is limited (false). The second is
+// always false if the first is.
+func (rs *RpcServer) checkAuth(r *http.Request) (bool, bool, error) {
+	if !rs.authRequired {
+		return true, true, nil
+	}
+
+	authhdr := r.Header["Authorization"]
+	if len(authhdr) <= 0 {
+		rlog.Warnf("RPC authentication failure from %s", r.RemoteAddr)
+		return false, false, errors.New("auth failure")
+	}
+
+	authsha := sha256.Sum256([]byte(authhdr[0]))
+
+	// Check for limited auth first as in environments with limited users,
+	// those are probably expected to have a higher volume of calls.  An
+	// unconfigured user has an all zero hash which no header can match.
+	limitcmp := subtle.ConstantTimeCompare(authsha[:], rs.limitauthsha[:])
+	if limitcmp == 1 {
+		return true, false, nil
+	}
+
+	// Check for admin-level auth
+	cmp := subtle.ConstantTimeCompare(authsha[:], rs.authsha[:])
+	if cmp == 1 {
+		return true, true, nil
+	}
+
+	// Request's auth doesn't match either user
+	rlog.Warnf("RPC authentication failure from %s", r.RemoteAddr)
+	return false, false, errors.New("auth failure")
+}
+
+// authenticate returns the principal the request is made on behalf of, using
+// the configured Authenticator or, without one, the HTTP Basic authentication
+// users of the config.  A nil principal is returned when no authentication is
+// configured.
+func (rs *RpcServer) authenticate(r *http.Request) (*Principal, error) {
+	if rs.Config.Authenticator != nil {
+		return rs.Config.Authenticator.Authenticate(r)
+	}
+	if !rs.authRequired {
+		return nil, nil
+	}
+
+	authenticated, isAdmin, err := rs.checkAuth(r)
+	if err != nil {
+		return nil, err
+	}
+	if !authenticated {
+		return nil, errors.New("auth failure")
+	}
+	if isAdmin {
+		return &Principal{
+			Name:  rs.Config.RPCUser,
+			Roles: []string{RoleAdmin},
+		}, nil
+	}
+	return &Principal{
+		Name:  rs.Config.RPCLimitUser,
+		Roles: []string{RoleLimited},
+	}, nil
+}
+
+// authorize returns an error suitable for use in replies when the principal
+// may not call the passed method.  Limited users are restricted to
+// RPCLimitedMethods, and methods registered WithRoles require one of their
+// roles unless the principal is an admin.  It is called with the method name
+// of the request before its params are parsed, so limited users can not tell
+// unknown methods from forbidden ones.
+func (rs *RpcServer) authorize(method string, principal *Principal) error {
+	if principal.HasRole(RoleLimited) && !principal.HasRole(RoleAdmin) &&
+		!rs.isLimitedMethod(method) {
+
+		return &RPCError{
+			Code:    ErrRPCUnauthorized.Code,
+			Message: "limited user not authorized for this method",
+		}
+	}
+
+	// Admins may call every method.
+	roles := rs.registry.methodRoles(method)
+	if len(roles) == 0 || principal.HasRole(RoleAdmin) {
+		return nil
+	}
+	for _, role := range roles {
+		if principal.HasRole(role) {
+			return nil
+		}
+	}
+	return ErrRPCUnauthorized
+}
+
+// authChallenge returns the WWW-Authenticate header for a request rejected by
+// authenticate, which is chosen by the configured Authenticator when it is an
+// AuthChallenger.
+func (rs *RpcServer) authChallenge(r *http.Request) string {
+	if c, ok := rs.Config.Authenticator.(AuthChallenger); ok {
+		return c.Challenge(r)
+	}
+	return basicAuthChallenge
+}
+
+// jsonAuthFail sends a message back to the client if the http auth is rejected.
+func jsonAuthFail(w http.ResponseWriter, challenge string) {
+	w.Header().Add("WWW-Authenticate", challenge)
+	http.Error(w, "401 Unauthorized.", http.StatusUnauthorized)
+}
+
+// isLimitedMethod returns whether limited users may call the passed method.
+func (rs *RpcServer) isLimitedMethod(method string) bool {
+	_, ok := rs.rpcLimited[method]
+	return ok
+}
@@ -0,0 +1,76 @@
+package gorpc
+
+import (
+	"context"
+)
+
+// Transport identifies how a request reached the server.
+type Transport string
+
+const (
+	// TransportHTTP is used for requests sent with HTTP POST.
+	TransportHTTP Transport = "http"
+
+	// TransportWebsocket is used for requests sent over a websocket.
+	TransportWebsocket Transport = "websocket"
+)
+
+// RequestInfo describes the request a handler is run for.
+type RequestInfo struct {
+	// ID and Method are the id and method of the JSON-RPC request.  For a
+	// batch every element has its own RequestInfo.
+	ID     interface{}
+	Method string
+
+	// RemoteAddr is the address of the client.
+	RemoteAddr string
+
+	// Principal is the identity the client authenticated as, nil for
+	// unauthenticated clients.
+	Principal *Principal
+
+	// Transport is how the request reached the server.
+	Transport Transport
+}
+
+// requestInfoKey is the context key of the RequestInfo.
+type requestInfoKey struct{}
+
+// RequestInfoFromContext returns the RequestInfo carried by the context passed
+// to a handler.
+func RequestInfoFromContext(ctx context.Context) (*RequestInfo, bool) {
+	info, ok := ctx.Value(requestInfoKey{}).(*RequestInfo)
+	return info, ok
+}
+
+// withRequestInfo returns a copy of ctx carrying the passed RequestInfo.
+func withRequestInfo(ctx context.Context, info *RequestInfo) context.Context {
+	return context.WithValue(ctx, requestInfoKey{}, info)
+}
+
+// requestContext returns the context to run the handler of the passed request
+// with.  It carries the RequestInfo of the connection ctx, completed with the
+// id and method of the request, and is cancelled along with ctx.  Every
+// request gets its own Done channel, even the elements of a batch, so the
+// returned cancel function must be called once the handler returned.
+func requestContext(ctx context.Context, request *Request) (context.Context, context.CancelFunc) {
+	var info RequestInfo
+	if connInfo, ok := RequestInfoFromContext(ctx); ok {
+		info = *connInfo
+	}
+	info.ID = request.ID
+	info.Method = request.Method
+	ctx, cancel := context.WithCancel(ctx)
+	return withRequestInfo(ctx, &info), cancel
+}
+
+// PrincipalFromContext returns the principal of the request the context
+// passed to a handler belongs to, nil for unauthenticated clients.  The claims
+// of the token the client authenticated with are available as its Claims.
+func PrincipalFromContext(ctx context.Context) *Principal {
+	info, ok := RequestInfoFromContext(ctx)
+	if !ok {
+		return nil
+	}
+	return info.Principal
+}
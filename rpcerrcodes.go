@@ -0,0 +1,217 @@
+package gorpc
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// Error code namespaces known to every server.
+const (
+	// NamespaceJSONRPC holds the errors predefined by the JSON-RPC 2.0 spec.
+	// It is reserved, applications cannot register codes in it.
+	NamespaceJSONRPC = "jsonrpc"
+
+	// NamespaceServer holds the implementation-defined server errors from
+	// -32099 to -32000.  Applications may register their codes in it, or in
+	// a namespace of their own created with RegisterErrorNamespace.
+	NamespaceServer = "server"
+)
+
+// The range of codes reserved by the JSON-RPC 2.0 spec, which includes the
+// server error range.
+const (
+	minReservedErrorCode RPCErrorCode = -32768
+	maxReservedErrorCode RPCErrorCode = -32000
+)
+
+// ErrorCodeInfo describes an error code the server can emit.
+type ErrorCodeInfo struct {
+	Code        RPCErrorCode `json:"code"`
+	Namespace   string       `json:"namespace"`
+	Name        string       `json:"name"`
+	Description string       `json:"description"`
+}
+
+// errorNamespace is a range of error codes owned by a single application, or
+// by the package itself.
+type errorNamespace struct {
+	name     string
+	min      RPCErrorCode
+	max      RPCErrorCode
+	reserved bool
+}
+
+var errCodeLock sync.RWMutex
+var errorNamespaces = make(map[string]*errorNamespace)
+var errorCodeInfos = make(map[RPCErrorCode]ErrorCodeInfo)
+
+// RegisterErrorNamespace creates a namespace owning the error codes from min
+// to max, inclusive.  The range must neither overlap the codes reserved by the
+// JSON-RPC 2.0 spec, from -32768 to -32000, nor the range of another
+// namespace.
+func RegisterErrorNamespace(name string, min, max RPCErrorCode) error {
+	errCodeLock.Lock()
+	defer errCodeLock.Unlock()
+
+	if name == "" || min > max {
+		str := fmt.Sprintf("invalid error namespace %q [%d, %d]", name,
+			min, max)
+		return makeError(ErrInvalidErrorCode, str)
+	}
+	if _, ok := errorNamespaces[name]; ok {
+		str := fmt.Sprintf("error namespace %q is already registered",
+			name)
+		return makeError(ErrDuplicateErrorCode, str)
+	}
+	if min <= maxReservedErrorCode && max >= minReservedErrorCode {
+		str := fmt.Sprintf("error namespace %q [%d, %d] overlaps the "+
+			"codes reserved by JSON-RPC", name, min, max)
+		return makeError(ErrInvalidErrorCode, str)
+	}
+	for _, ns := range errorNamespaces {
+		if min <= ns.max && max >= ns.min {
+			str := fmt.Sprintf("error namespace %q [%d, %d] overlaps "+
+				"namespace %q", name, min, max, ns.name)
+			return makeError(ErrDuplicateErrorCode, str)
+		}
+	}
+
+	errorNamespaces[name] = &errorNamespace{name: name, min: min, max: max}
+	return nil
+}
+
+// RegisterErrorCode registers an application error code in the passed
+// namespace and returns the error to send to clients, whose message is the
+// description.  The code must lie in the range of the namespace and the code,
+// as well as the name within the namespace, must not be registered yet.
+//
+// The returned error matches every error with the same code, including copies
+// carrying data, when compared with errors.Is.
+func RegisterErrorCode(namespace string, code RPCErrorCode, name, description string) (*RPCError, error) {
+	errCodeLock.Lock()
+	defer errCodeLock.Unlock()
+
+	ns, ok := errorNamespaces[namespace]
+	if !ok {
+		str := fmt.Sprintf("error namespace %q is not registered",
+			namespace)
+		return nil, makeError(ErrInvalidErrorCode, str)
+	}
+	if ns.reserved {
+		str := fmt.Sprintf("error namespace %q is reserved", namespace)
+		return nil, makeError(ErrInvalidErrorCode, str)
+	}
+	if code < ns.min || code > ns.max {
+		str := fmt.Sprintf("error code %d is outside the range [%d, %d] "+
+			"of namespace %q", code, ns.min, ns.max, namespace)
+		return nil, makeError(ErrInvalidErrorCode, str)
+	}
+	return registerErrorCode(ErrorCodeInfo{
+		Code:        code,
+		Namespace:   namespace,
+		Name:        name,
+		Description: description,
+	})
+}
+
+// MustRegisterErrorCode performs the same function as RegisterErrorCode
+// except it panics if there is an error, so collisions are detected at init
+// time.  This should only be called from package init functions.
+func MustRegisterErrorCode(namespace string, code RPCErrorCode, name, description string) *RPCError {
+	rpcErr, err := RegisterErrorCode(namespace, code, name, description)
+	if err != nil {
+		panic(fmt.Sprintf("failed to register error code %d:%v\n", code,
+			err))
+	}
+	return rpcErr
+}
+
+// registerErrorCode adds the passed code to the registry.  It must be called
+// with errCodeLock held.
+func registerErrorCode(info ErrorCodeInfo) (*RPCError, error) {
+	if other, ok := errorCodeInfos[info.Code]; ok {
+		str := fmt.Sprintf("error code %d is already registered as "+
+			"%s.%s", info.Code, other.Namespace, other.Name)
+		return nil, makeError(ErrDuplicateErrorCode, str)
+	}
+	for _, other := range errorCodeInfos {
+		if other.Namespace == info.Namespace && other.Name == info.Name {
+			str := fmt.Sprintf("error name %s.%s is already "+
+				"registered", info.Namespace, info.Name)
+			return nil, makeError(ErrDuplicateErrorCode, str)
+		}
+	}
+
+	errorCodeInfos[info.Code] = info
+	return &RPCError{
+		Code:    info.Code,
+		Message: info.Description,
+	}, nil
+}
+
+// ErrorCodes returns every error code the server can emit, ordered by code.
+// It is also served by the geterrorcodes command.
+func ErrorCodes() []ErrorCodeInfo {
+	errCodeLock.RLock()
+	infos := make([]ErrorCodeInfo, 0, len(errorCodeInfos))
+	for _, info := range errorCodeInfos {
+		infos = append(infos, info)
+	}
+	errCodeLock.RUnlock()
+
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].Code < infos[j].Code
+	})
+	return infos
+}
+
+// LookupErrorCode returns the registered description of the passed code.
+func LookupErrorCode(code RPCErrorCode) (ErrorCodeInfo, bool) {
+	errCodeLock.RLock()
+	info, ok := errorCodeInfos[code]
+	errCodeLock.RUnlock()
+	return info, ok
+}
+
+func init() {
+	errorNamespaces[NamespaceJSONRPC] = &errorNamespace{
+		name:     NamespaceJSONRPC,
+		min:      minReservedErrorCode,
+		max:      -32100,
+		reserved: true,
+	}
+	errorNamespaces[NamespaceServer] = &errorNamespace{
+		name: NamespaceServer,
+		min:  -32099,
+		max:  maxReservedErrorCode,
+	}
+
+	builtins := []struct {
+		namespace string
+		name      string
+		err       *RPCError
+	}{
+		{NamespaceJSONRPC, "parse", ErrRPCParse},
+		{NamespaceJSONRPC, "invalid_request", ErrRPCInvalidRequest},
+		{NamespaceJSONRPC, "method_not_found", ErrRPCMethodNotFound},
+		{NamespaceJSONRPC, "invalid_params", ErrRPCInvalidParams},
+		{NamespaceJSONRPC, "internal", ErrRPCInternal},
+		{NamespaceServer, "unauthorized", ErrRPCUnauthorized},
+		{NamespaceServer, "rate_limited", ErrRPCRateLimited},
+		{NamespaceServer, "timeout", ErrRPCTimeout},
+		{NamespaceServer, "unimplemented", ErrRPCUnimplemented},
+	}
+	for _, b := range builtins {
+		_, err := registerErrorCode(ErrorCodeInfo{
+			Code:        b.err.Code,
+			Namespace:   b.namespace,
+			Name:        b.name,
+			Description: b.err.Message,
+		})
+		if err != nil {
+			panic(fmt.Sprintf("failed to register error code %d:%v\n",
+				b.err.Code, err))
+		}
+	}
+}
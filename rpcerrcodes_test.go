@@ -0,0 +1,155 @@
+package gorpc
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"testing"
+)
+
+// TestRegisterErrorCode ensures application error codes are checked against
+// the ranges of their namespace and collisions are rejected.
+func TestRegisterErrorCode(t *testing.T) {
+	// Drop the codes registered by the test again, the error code
+	// registry is shared by the whole package.
+	t.Cleanup(func() {
+		errCodeLock.Lock()
+		delete(errorNamespaces, "testapp")
+		delete(errorCodeInfos, 1000)
+		delete(errorCodeInfos, -32050)
+		errCodeLock.Unlock()
+	})
+	if err := RegisterErrorNamespace("testapp", 1000, 1099); err != nil {
+		t.Fatalf("RegisterErrorNamespace: unexpected error: %v", err)
+	}
+	errInsufficient, err := RegisterErrorCode("testapp", 1000,
+		"insufficient_funds", "Insufficient funds")
+	if err != nil {
+		t.Fatalf("RegisterErrorCode: unexpected error: %v", err)
+	}
+	if _, err := RegisterErrorCode(NamespaceServer, -32050, "testbusy",
+		"Busy"); err != nil {
+		t.Fatalf("RegisterErrorCode: unexpected error: %v", err)
+	}
+
+	namespaceTests := []struct {
+		name     string
+		min, max RPCErrorCode
+		code     ErrorCode
+	}{
+		{"testapp", 2000, 2099, ErrDuplicateErrorCode},
+		{"testother", 1050, 1150, ErrDuplicateErrorCode},
+		{"testreserved", -32100, -32000, ErrInvalidErrorCode},
+		{"testinverted", 10, 1, ErrInvalidErrorCode},
+		{"", 10, 20, ErrInvalidErrorCode},
+	}
+	for _, test := range namespaceTests {
+		err := RegisterErrorNamespace(test.name, test.min, test.max)
+		if e, ok := err.(Error); !ok || e.ErrorCode != test.code {
+			t.Errorf("RegisterErrorNamespace(%q, %d, %d): got %v, "+
+				"want %v", test.name, test.min, test.max, err,
+				test.code)
+		}
+	}
+
+	codeTests := []struct {
+		namespace string
+		code      RPCErrorCode
+		name      string
+		want      ErrorCode
+	}{
+		{"testapp", 1000, "other", ErrDuplicateErrorCode},
+		{"testapp", 1001, "insufficient_funds", ErrDuplicateErrorCode},
+		{"testapp", 1100, "outside", ErrInvalidErrorCode},
+		{NamespaceServer, ErrRPCTimeout.Code, "timeout2",
+			ErrDuplicateErrorCode},
+		{NamespaceJSONRPC, -32500, "reserved", ErrInvalidErrorCode},
+		{"testunknown", 1, "unknown", ErrInvalidErrorCode},
+	}
+	for _, test := range codeTests {
+		_, err := RegisterErrorCode(test.namespace, test.code,
+			test.name, "")
+		if e, ok := err.(Error); !ok || e.ErrorCode != test.want {
+			t.Errorf("RegisterErrorCode(%q, %d, %q): got %v, want %v",
+				test.namespace, test.code, test.name, err,
+				test.want)
+		}
+	}
+
+	info, ok := LookupErrorCode(1000)
+	if !ok || info.Name != "insufficient_funds" ||
+		info.Description != errInsufficient.Message {
+
+		t.Errorf("LookupErrorCode: got %+v, %v", info, ok)
+	}
+
+	// The codes are served by geterrorcodes, including the builtin ones.
+	_, addr := newTestServer(t, &RpcServerConfig{})
+	reply := postJSON(t, addr, `{"jsonrpc":"2.0","method":"geterrorcodes","params":[],"id":1}`)
+	var resp struct {
+		Result []ErrorCodeInfo `json:"result"`
+	}
+	if err := json.Unmarshal(reply, &resp); err != nil {
+		t.Fatalf("Unmarshal: unexpected error: %v", err)
+	}
+	codes := make(map[RPCErrorCode]string)
+	for i, info := range resp.Result {
+		if i > 0 && resp.Result[i-1].Code >= info.Code {
+			t.Errorf("codes are not ordered: %v", resp.Result)
+		}
+		codes[info.Code] = info.Name
+	}
+	for code, name := range map[RPCErrorCode]string{
+		ErrRPCParse.Code:       "parse",
+		ErrRPCRateLimited.Code: "rate_limited",
+		-32050:                 "testbusy",
+		errInsufficient.Code:   "insufficient_funds",
+	} {
+		if codes[code] != name {
+			t.Errorf("code %d: got name %q, want %q", code,
+				codes[code], name)
+		}
+	}
+}
+
+// TestErrorIs ensures RPC errors are matched by code and can be unwrapped.
+func TestErrorIs(t *testing.T) {
+	withData := ErrRPCRateLimited.WithData(&RetryErrorData{RetryAfter: 1})
+	wrapped := fmt.Errorf("handler: %w", withData)
+	if !errors.Is(wrapped, ErrRPCRateLimited) {
+		t.Error("errors.Is: wrapped error does not match its code")
+	}
+	if errors.Is(wrapped, ErrRPCTimeout) {
+		t.Error("errors.Is: wrapped error matches another code")
+	}
+	if !errors.Is(*ErrRPCTimeout, ErrRPCTimeout) {
+		t.Error("errors.Is: value does not match its pointer")
+	}
+
+	var rpcErr *RPCError
+	if !errors.As(fmt.Errorf("x: %w", *withData), &rpcErr) ||
+		rpcErr.Code != ErrRPCRateLimited.Code {
+
+		t.Errorf("errors.As: got %v", rpcErr)
+	}
+	if got := toRPCError(wrapped); got != withData {
+		t.Errorf("toRPCError: got %v, want the wrapped error", got)
+	}
+
+	// Errors decoded from JSON keep their data as a json.RawMessage,
+	// which must not make errors.Is panic when comparing values.
+	var decoded, target RPCError
+	data := []byte(`{"code":-32002,"message":"slow down","data":{"retry_after":1}}`)
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		t.Fatalf("Unmarshal: unexpected error: %v", err)
+	}
+	if err := json.Unmarshal(data, &target); err != nil {
+		t.Fatalf("Unmarshal: unexpected error: %v", err)
+	}
+	if !errors.Is(decoded, target) || !errors.Is(decoded, ErrRPCRateLimited) {
+		t.Error("errors.Is: decoded error does not match its code")
+	}
+	if errors.Is(decoded, *ErrRPCTimeout) {
+		t.Error("errors.Is: decoded error matches another code")
+	}
+}
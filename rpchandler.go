@@ -1,6 +1,10 @@
 package gorpc
 import (
+"context"
+"fmt"
 "math/rand"
+"sort"
+"strings"
 "time"
 )
 
@@ -12,15 +16,178 @@ type GetReadMeReasult struct {
 	Info string `json:"info"`
 }
 
+// geterrorcodes指令，返回服务器可能返回的所有错误码
+type GetErrorCodesCmd struct{}
+
 // 需要chan，处理完成后通知断开Hijack()之后的链接
 type commandHandler func(*RpcServer, interface{}, <-chan struct{}) (interface{}, error)
 
-var rpcHandlers = map[string]commandHandler{
-	"getreadme": handleGetReadMe,
-}
+// ContextHandler describes a callback function used to handle a specific
+// command.  The context is cancelled when the client disconnects, the server
+// shuts down or the timeout of the method expires, and carries the
+// RequestInfo of the request.
+type ContextHandler func(ctx context.Context, s *RpcServer, cmd interface{}) (interface{}, error)
 
 func AddRpcHandler(method string, handler commandHandler) {
-	rpcHandlers[method] = handler
+	defaultRegistry.AddRpcHandler(method, handler)
+}
+
+// AddRpcHandler adds a handler for the passed method to the registry.
+func (r *Registry) AddRpcHandler(method string, handler commandHandler) {
+	r.AddRpcContextHandler(method, adaptHandler(handler))
+}
+
+// AddRpcContextHandler adds a handler receiving a context.Context for the
+// passed method.
+func AddRpcContextHandler(method string, handler ContextHandler) {
+	defaultRegistry.AddRpcContextHandler(method, handler)
+}
+
+// AddRpcContextHandler adds a handler receiving a context.Context for the
+// passed method to the registry.  Websocket clients are notified when the
+// method could not be called before.  A nil handler is ignored.
+func (r *Registry) AddRpcContextHandler(method string, handler ContextHandler) {
+	if handler == nil {
+		return
+	}
+	r.updateMethod(method, func() error {
+		r.rpcHandlers[method] = handler
+		return nil
+	})
+}
+
+// rpcHandler returns the handler of the passed method.
+func (r *Registry) rpcHandler(method string) (ContextHandler, bool) {
+	r.mtx.RLock()
+	defer r.mtx.RUnlock()
+	handler, ok := r.rpcHandlers[method]
+	return handler, ok
+}
+
+// adaptHandler returns a ContextHandler running a handler with the old
+// signature, whose closeChan is closed once the context is cancelled.  It
+// returns nil for a nil handler, so no handler is stored for the method.
+func adaptHandler(handler commandHandler) ContextHandler {
+	if handler == nil {
+		return nil
+	}
+	return func(ctx context.Context, s *RpcServer, cmd interface{}) (interface{}, error) {
+		return handler(s, cmd, ctx.Done())
+	}
+}
+
+// AddUnimplemented marks a registered command as known but not implemented,
+// so calling it returns ErrRPCUnimplemented instead of ErrRPCMethodNotFound.
+func AddUnimplemented(method string) {
+	defaultRegistry.AddUnimplemented(method)
+}
+
+// AddUnimplemented marks a command of the registry as known but not
+// implemented.  Websocket clients are notified when the method could not be
+// called before.
+func (r *Registry) AddUnimplemented(method string) {
+	r.updateMethod(method, func() error {
+		r.unimplemented[method] = struct{}{}
+		return nil
+	})
+}
+
+// updateMethod runs update with the registry lock held and notifies the
+// websocket clients of the servers serving the registry when it made the
+// method callable.  An error returned by update is passed on and nothing is
+// notified.
+func (r *Registry) updateMethod(method string, update func() error) error {
+	r.mtx.Lock()
+	wasCallable := r.callable(method)
+	if err := update(); err != nil {
+		r.mtx.Unlock()
+		return err
+	}
+	added := !wasCallable && r.callable(method)
+	servers := r.serverList()
+	r.mtx.Unlock()
+
+	if added {
+		notifyMethodsChanged(servers, []string{method}, nil)
+	}
+	return nil
+}
+
+// callable returns whether a call of the passed method reaches a handler,
+// which includes the one of unimplemented methods.  It must be called with
+// the registry lock held.
+func (r *Registry) callable(method string) bool {
+	_, rpcOK := r.rpcHandlers[method]
+	_, wsOK := r.wsHandlers[method]
+	_, unimplemented := r.unimplemented[method]
+	return rpcOK || wsOK || unimplemented
+}
+
+// isUnimplemented returns whether the passed method is marked as
+// unimplemented.
+func (r *Registry) isUnimplemented(method string) bool {
+	r.mtx.RLock()
+	defer r.mtx.RUnlock()
+	_, ok := r.unimplemented[method]
+	return ok
+}
+
+// handleUnimplemented is the handler for commands that aren't yet implemented.
+func handleUnimplemented(ctx context.Context, s *RpcServer, cmd interface{}) (interface{}, error) {
+	return nil, ErrRPCUnimplemented
+}
+
+// validateHandlers checks that every registered command has a handler, unless
+// it is a notification or marked as unimplemented, and that every handler
+// belongs to a registered command.  The returned error lists every problem.
+func (r *Registry) validateHandlers() error {
+	var problems []string
+	r.mtx.RLock()
+	for method, info := range r.methodToInfo {
+		if info.flags&UFNotification != 0 {
+			continue
+		}
+		_, hasHandler := r.rpcHandlers[method]
+		_, hasWsHandler := r.wsHandlers[method]
+		_, unimplemented := r.unimplemented[method]
+		if !hasHandler && !hasWsHandler && !unimplemented {
+			problems = append(problems, fmt.Sprintf("command %q "+
+				"has no handler", method))
+		}
+	}
+	for method := range r.handlerMethods() {
+		if _, ok := r.methodToInfo[method]; !ok {
+			problems = append(problems, fmt.Sprintf("handler for "+
+				"%q has no registered command", method))
+		}
+	}
+	for method := range r.unimplemented {
+		if _, ok := r.methodToInfo[method]; !ok {
+			problems = append(problems, fmt.Sprintf("unimplemented "+
+				"command %q is not registered", method))
+		}
+	}
+	r.mtx.RUnlock()
+
+	if len(problems) == 0 {
+		return nil
+	}
+	sort.Strings(problems)
+	return fmt.Errorf("inconsistent command registry: %s",
+		strings.Join(problems, "; "))
+}
+
+// handlerMethods returns the methods that have an HTTP or websocket handler.
+// It must be called with the mutex held.
+func (r *Registry) handlerMethods() map[string]struct{} {
+	methods := make(map[string]struct{}, len(r.rpcHandlers)+len(r.wsHandlers))
+	for method := range r.rpcHandlers {
+		methods[method] = struct{}{}
+	}
+	for method := range r.wsHandlers {
+		methods[method] = struct{}{}
+	}
+	return methods
 }
 
 func handleGetReadMe(s *RpcServer, cmd interface{}, closeChan <-chan struct{}) (interface{}, error) {
@@ -30,9 +197,29 @@ func handleGetReadMe(s *RpcServer, cmd interface{}, closeChan <-chan struct{}) (
 	}
 	return readme, nil
 }
-func init() {
-	rand.Seed(time.Now().UnixNano())
+
+// handleGetErrorCodes implements the geterrorcodes command.
+func handleGetErrorCodes(s *RpcServer, cmd interface{}, closeChan <-chan struct{}) (interface{}, error) {
+	return ErrorCodes(), nil
+}
+
+// RegisterBuiltins adds the commands every default registry comes with,
+// getreadme and geterrorcodes, to the registry.
+func (r *Registry) RegisterBuiltins() error {
 	flags := UsageFlag(0) //
 	// (*GetReadMeCmd)(nil) 相当于*GetReadMeCmd类型的指针的初始化
-	MustRegisterCmd("getreadme", (*GetReadMeCmd)(nil), flags)
+	err := r.register("getreadme", (*GetReadMeCmd)(nil), flags, nil,
+		adaptHandler(handleGetReadMe), nil)
+	if err != nil {
+		return err
+	}
+	return r.register("geterrorcodes", (*GetErrorCodesCmd)(nil), flags,
+		nil, adaptHandler(handleGetErrorCodes), nil)
+}
+
+func init() {
+	rand.Seed(time.Now().UnixNano())
+	if err := defaultRegistry.RegisterBuiltins(); err != nil {
+		panic(fmt.Sprintf("failed to register builtins:%v\n", err))
+	}
 }
@@ -0,0 +1,246 @@
+package gorpc
+
+import (
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// rateLimitPruneInterval is how often buckets of clients that stopped sending
+// requests are dropped.
+const rateLimitPruneInterval = time.Minute
+
+// tokenBucket holds the tokens left for a single client.
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// rateLimiter is a token bucket rate limiter keyed by client.  Every client
+// starts with burst tokens, each request takes one and tokens are refilled at
+// rate per second.
+type rateLimiter struct {
+	rate  float64
+	burst float64
+
+	mtx       sync.Mutex
+	buckets   map[string]*tokenBucket
+	lastPrune time.Time
+}
+
+// newRateLimiter returns a rateLimiter for the passed rate and burst.  A burst
+// below one allows a single request at a time.
+func newRateLimiter(rate float64, burst int) *rateLimiter {
+	if burst < 1 {
+		burst = 1
+	}
+	return &rateLimiter{
+		rate:      rate,
+		burst:     float64(burst),
+		buckets:   make(map[string]*tokenBucket),
+		lastPrune: time.Now(),
+	}
+}
+
+// allow takes a token from the bucket of the passed client and returns
+// whether one was left.
+func (rl *rateLimiter) allow(key string, now time.Time) bool {
+	rl.mtx.Lock()
+	defer rl.mtx.Unlock()
+
+	if now.Sub(rl.lastPrune) >= rateLimitPruneInterval {
+		rl.prune(now)
+	}
+
+	b, ok := rl.buckets[key]
+	if !ok {
+		b = &tokenBucket{tokens: rl.burst, last: now}
+		rl.buckets[key] = b
+	}
+	b.tokens += now.Sub(b.last).Seconds() * rl.rate
+	if b.tokens > rl.burst {
+		b.tokens = rl.burst
+	}
+	b.last = now
+
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// retryAfter returns how long the passed client has to wait for its next
+// token.
+func (rl *rateLimiter) retryAfter(key string, now time.Time) time.Duration {
+	rl.mtx.Lock()
+	defer rl.mtx.Unlock()
+
+	b, ok := rl.buckets[key]
+	if !ok {
+		return 0
+	}
+	tokens := b.tokens + now.Sub(b.last).Seconds()*rl.rate
+	if tokens >= 1 {
+		return 0
+	}
+	return time.Duration((1 - tokens) / rl.rate * float64(time.Second))
+}
+
+// prune drops the buckets which have been refilled completely, since they are
+// indistinguishable from the bucket of a new client.  It must be called with
+// the mutex held.
+func (rl *rateLimiter) prune(now time.Time) {
+	for key, b := range rl.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*rl.rate >= rl.burst {
+			delete(rl.buckets, key)
+		}
+	}
+	rl.lastPrune = now
+}
+
+// setupLimits creates the rate limiter and the handler semaphore from the
+// config.
+func (rs *RpcServer) setupLimits() {
+	config := rs.Config
+	if config.RPCRateLimit > 0 {
+		rs.rateLimiter = newRateLimiter(config.RPCRateLimit,
+			config.RPCRateBurst)
+	}
+	if config.RPCMaxConcurrentReqs > 0 {
+		rs.handlerSem = make(chan struct{}, config.RPCMaxConcurrentReqs)
+	}
+	rs.methodActive = make(map[string]int)
+}
+
+// rateLimitKey returns the key of the token bucket of the passed client.
+// Authenticated clients are limited by their name and all others by their IP
+// address.
+func rateLimitKey(principal *Principal, remoteAddr string) string {
+	if principal != nil && principal.Name != "" {
+		return "user:" + principal.Name
+	}
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+	return "ip:" + host
+}
+
+// allowRequest returns ErrRPCRateLimited, along with a hint when to retry, if
+// the rate limit does not let a new request from the passed client through.
+func (rs *RpcServer) allowRequest(principal *Principal, remoteAddr string) *RPCError {
+	if rs.rateLimiter == nil {
+		return nil
+	}
+
+	key := rateLimitKey(principal, remoteAddr)
+	now := time.Now()
+	if !rs.rateLimiter.allow(key, now) {
+		rlog.Warnf("RPC rate limit exceeded by %s", key)
+		return rateLimitedError(rs.rateLimiter.retryAfter(key, now))
+	}
+	return nil
+}
+
+// allowAuth returns ErrRPCRateLimited if the IP address of the passed client
+// has no token left, so clients that keep failing to authenticate are
+// rejected before their credentials are checked.  It does not take a token,
+// that is left to authFailed.
+func (rs *RpcServer) allowAuth(remoteAddr string) *RPCError {
+	if rs.rateLimiter == nil {
+		return nil
+	}
+
+	key := rateLimitKey(nil, remoteAddr)
+	if retryAfter := rs.rateLimiter.retryAfter(key, time.Now()); retryAfter > 0 {
+		rlog.Warnf("RPC rate limit exceeded by %s", key)
+		return rateLimitedError(retryAfter)
+	}
+	return nil
+}
+
+// authFailed takes a token from the bucket of the IP address of a client
+// that failed to authenticate.
+func (rs *RpcServer) authFailed(remoteAddr string) {
+	if rs.rateLimiter == nil {
+		return
+	}
+	rs.rateLimiter.allow(rateLimitKey(nil, remoteAddr), time.Now())
+}
+
+// rateLimitedError returns ErrRPCRateLimited with the passed hint when to
+// retry.
+func rateLimitedError(retryAfter time.Duration) *RPCError {
+	return NewRetryError(ErrRPCRateLimited.Code, ErrRPCRateLimited.Message,
+		retryAfter)
+}
+
+// acquireHandler reserves a slot to run the handler of the passed method,
+// counting against RPCMaxConcurrentReqs and the cap the method was registered
+// with.  It returns ErrRPCRateLimited when either is exhausted, otherwise the
+// returned function must be called once the handler finished.
+func (rs *RpcServer) acquireHandler(method string) (func(), error) {
+	if rs.handlerSem != nil {
+		select {
+		case rs.handlerSem <- struct{}{}:
+		default:
+			rlog.Warnf("Reached maximum concurrent RPC handlers, "+
+				"rejecting <%s>", method)
+			return nil, ErrRPCRateLimited
+		}
+	}
+	releaseSem := func() {
+		if rs.handlerSem != nil {
+			<-rs.handlerSem
+		}
+	}
+
+	max := rs.registry.methodMaxConcurrent(method)
+	if max <= 0 {
+		return releaseSem, nil
+	}
+	rs.limitLock.Lock()
+	if rs.methodActive[method] >= max {
+		rs.limitLock.Unlock()
+		releaseSem()
+		rlog.Warnf("Reached maximum concurrent handlers for <%s>",
+			method)
+		return nil, ErrRPCRateLimited
+	}
+	rs.methodActive[method]++
+	rs.limitLock.Unlock()
+
+	return func() {
+		rs.limitLock.Lock()
+		rs.methodActive[method]--
+		rs.limitLock.Unlock()
+		releaseSem()
+	}, nil
+}
+
+// jsonRateLimited sends the passed error back to the client if the request is
+// rejected by the rate limit, setting the Retry-After header from its data.
+func jsonRateLimited(w http.ResponseWriter, jsonErr *RPCError) {
+	msg, err := createMarshalledReply(RPCVersion1, nil, nil, jsonErr)
+	if err != nil {
+		rlog.Errorf("Failed to marshal reply: %v", err)
+		return
+	}
+	if data, ok := jsonErr.Data.(*RetryErrorData); ok {
+		retryAfter := int(math.Ceil(data.RetryAfter))
+		w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+	}
+	w.WriteHeader(http.StatusTooManyRequests)
+	w.Write(msg)
+}
+
+// isRateLimited returns whether the passed reply error was caused by one of
+// the limits.
+func isRateLimited(err error) bool {
+	rpcErr, ok := err.(*RPCError)
+	return ok && rpcErr.Code == ErrRPCRateLimited.Code
+}
@@ -0,0 +1,220 @@
+package gorpc
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// TestRateLimiter ensures the token buckets allow bursts, refill over time
+// and are kept per client.
+func TestRateLimiter(t *testing.T) {
+	rl := newRateLimiter(2, 3)
+	now := time.Now()
+
+	for i := 0; i < 3; i++ {
+		if !rl.allow("a", now) {
+			t.Fatalf("request %d of the burst was rejected", i)
+		}
+	}
+	if rl.allow("a", now) {
+		t.Fatal("request exceeding the burst was allowed")
+	}
+	if !rl.allow("b", now) {
+		t.Fatal("request of another client was rejected")
+	}
+
+	// Two tokens are refilled per second.
+	now = now.Add(500 * time.Millisecond)
+	if !rl.allow("a", now) {
+		t.Fatal("request after refill was rejected")
+	}
+	if rl.allow("a", now) {
+		t.Fatal("request exceeding the refill was allowed")
+	}
+
+	// Idle buckets are dropped once they are full again.
+	now = now.Add(rateLimitPruneInterval)
+	rl.allow("c", now)
+	if len(rl.buckets) != 1 {
+		t.Fatalf("got %d buckets after pruning, want 1", len(rl.buckets))
+	}
+}
+
+// TestLimits ensures requests over the rate limit are rejected with HTTP 429
+// and calls exceeding the concurrency cap of a method with ErrRPCRateLimited.
+func TestLimits(t *testing.T) {
+	running := make(chan struct{})
+	release := make(chan struct{})
+	registry := newTestRegistry(t)
+	registry.Register("testcapped", (*blockCmd)(nil), func(s *RpcServer, cmd interface{}, closeChan <-chan struct{}) (interface{}, error) {
+		running <- struct{}{}
+		<-release
+		return "ok", nil
+	}, 0, WithMaxConcurrent(1))
+
+	_, addr := newTestServer(t, &RpcServerConfig{
+		Registry:     registry,
+		RPCRateLimit: 0.001,
+		RPCRateBurst: 2,
+	})
+
+	call := func(method string) (int, *RPCError, http.Header) {
+		resp, err := http.Post("http://"+addr, "application/json",
+			strings.NewReader(`{"jsonrpc":"2.0","method":"`+method+
+				`","params":[],"id":1}`))
+		if err != nil {
+			t.Fatalf("Post: unexpected error: %v", err)
+		}
+		defer resp.Body.Close()
+		var reply struct {
+			Error *RPCError `json:"error"`
+		}
+		if err := json.NewDecoder(resp.Body).Decode(&reply); err != nil {
+			t.Fatalf("Decode: unexpected error: %v", err)
+		}
+		return resp.StatusCode, reply.Error, resp.Header
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if status, rpcErr, _ := call("testcapped"); rpcErr != nil {
+			t.Errorf("first call: got status %d, error %v", status,
+				rpcErr)
+		}
+	}()
+	<-running
+
+	status, rpcErr, _ := call("testcapped")
+	if status != http.StatusTooManyRequests || rpcErr == nil ||
+		rpcErr.Code != ErrRPCRateLimited.Code {
+
+		t.Errorf("call over the method cap: got status %d, error %v",
+			status, rpcErr)
+	}
+	close(release)
+	<-done
+
+	// The burst of 2 is used up by the calls above.
+	status, rpcErr, header := call("getreadme")
+	if status != http.StatusTooManyRequests || rpcErr == nil ||
+		rpcErr.Code != ErrRPCRateLimited.Code {
+
+		t.Errorf("call over the rate limit: got status %d, error %v",
+			status, rpcErr)
+	}
+	if header.Get("Retry-After") == "" {
+		t.Error("call over the rate limit: missing Retry-After header")
+	}
+	var data RetryErrorData
+	if rpcErr == nil || rpcErr.DecodeData(&data) != nil ||
+		data.RetryAfter <= 0 {
+
+		t.Errorf("call over the rate limit: got data %+v", data)
+	}
+}
+
+// TestLimitsBatch ensures every element of a batch takes a token, so the
+// elements over the rate limit are rejected.
+func TestLimitsBatch(t *testing.T) {
+	_, addr := newTestServer(t, &RpcServerConfig{
+		RPCRateLimit: 0.001,
+		RPCRateBurst: 2,
+	})
+
+	resp, err := http.Post("http://"+addr, "application/json",
+		strings.NewReader(`[`+
+			`{"jsonrpc":"2.0","method":"getreadme","params":[],"id":1},`+
+			`{"jsonrpc":"2.0","method":"getreadme","params":[],"id":2},`+
+			`{"jsonrpc":"2.0","method":"getreadme","params":[],"id":3}]`))
+	if err != nil {
+		t.Fatalf("Post: unexpected error: %v", err)
+	}
+	defer resp.Body.Close()
+	var replies []struct {
+		ID    interface{} `json:"id"`
+		Error *RPCError   `json:"error"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&replies); err != nil {
+		t.Fatalf("Decode: unexpected error: %v", err)
+	}
+	if len(replies) != 3 {
+		t.Fatalf("got %d replies, want 3", len(replies))
+	}
+	for i, reply := range replies[:2] {
+		if reply.Error != nil {
+			t.Errorf("element %d: unexpected error: %v", i, reply.Error)
+		}
+	}
+	if rpcErr := replies[2].Error; rpcErr == nil ||
+		rpcErr.Code != ErrRPCRateLimited.Code || replies[2].ID != 3.0 {
+
+		t.Errorf("element over the rate limit: got id %v, error %v",
+			replies[2].ID, rpcErr)
+	}
+}
+
+// countingAuthenticator rejects every request and counts how often it was
+// asked to.
+type countingAuthenticator struct {
+	calls int32
+}
+
+func (a *countingAuthenticator) Authenticate(r *http.Request) (*Principal, error) {
+	atomic.AddInt32(&a.calls, 1)
+	return nil, errors.New("auth failure")
+}
+
+// TestLimitsAuthFailure ensures failed authentication attempts take tokens of
+// the client IP address, and that clients without tokens left are rejected
+// before the authenticator is run.
+func TestLimitsAuthFailure(t *testing.T) {
+	auth := &countingAuthenticator{}
+	_, addr := newTestServer(t, &RpcServerConfig{
+		RPCRateLimit:  0.001,
+		RPCRateBurst:  2,
+		Authenticator: auth,
+	})
+
+	post := func() int {
+		resp, err := http.Post("http://"+addr, "application/json",
+			strings.NewReader(`{"jsonrpc":"2.0","method":"getreadme","params":[],"id":1}`))
+		if err != nil {
+			t.Fatalf("Post: unexpected error: %v", err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	for i := 0; i < 2; i++ {
+		if status := post(); status != http.StatusUnauthorized {
+			t.Fatalf("attempt %d: got status %d, want %d", i, status,
+				http.StatusUnauthorized)
+		}
+	}
+	if status := post(); status != http.StatusTooManyRequests {
+		t.Errorf("attempt over the rate limit: got status %d, want %d",
+			status, http.StatusTooManyRequests)
+	}
+	if calls := atomic.LoadInt32(&auth.calls); calls != 2 {
+		t.Errorf("authenticator ran %d times, want 2", calls)
+	}
+
+	// The websocket upgrade is limited the same way.
+	_, resp, err := websocket.DefaultDialer.Dial("ws://"+addr+"/ws", nil)
+	if err == nil || resp == nil ||
+		resp.StatusCode != http.StatusTooManyRequests {
+
+		t.Errorf("websocket upgrade over the rate limit: got %v", err)
+	}
+	if calls := atomic.LoadInt32(&auth.calls); calls != 2 {
+		t.Errorf("authenticator ran %d times, want 2", calls)
+	}
+}
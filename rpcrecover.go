@@ -0,0 +1,79 @@
+package gorpc
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"runtime/debug"
+)
+
+// PanicInfo describes a panic recovered from a handler.
+type PanicInfo struct {
+	// IncidentID identifies the panic.  It is the only detail sent to the
+	// client, so it can be used to correlate a failed call with the logs.
+	IncidentID string
+
+	// Method is the method whose handler panicked.
+	Method string
+
+	// Request describes the request the handler was run for.  It is nil
+	// when the handler was run without request metadata.
+	Request *RequestInfo
+
+	// Value is the value passed to panic and Stack the stack trace of the
+	// panicking goroutine.
+	Value interface{}
+	Stack []byte
+}
+
+// newIncidentID returns a random identifier for a recovered panic.
+func newIncidentID() string {
+	var b [8]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "unknown"
+	}
+	return hex.EncodeToString(b[:])
+}
+
+// callHandler runs the passed handler of a method and turns a panic into an
+// ErrRPCInternal reply, so a broken handler does not take the whole server
+// down.
+func (s *RpcServer) callHandler(ctx context.Context, method string, handler func(context.Context) (interface{}, error)) (result interface{}, err error) {
+	defer func() {
+		if value := recover(); value != nil {
+			info := &PanicInfo{
+				IncidentID: newIncidentID(),
+				Method:     method,
+				Value:      value,
+				Stack:      debug.Stack(),
+			}
+			info.Request, _ = RequestInfoFromContext(ctx)
+			result, err = nil, s.handlePanic(info)
+		}
+	}()
+	return handler(ctx)
+}
+
+// handlePanic logs a panic recovered from a handler, passes it on to the
+// OnPanic hook and returns the error to reply with.
+func (s *RpcServer) handlePanic(info *PanicInfo) error {
+	rlog.Errorf("Handler for <%s> panicked (incident %s): %v\n%s",
+		info.Method, info.IncidentID, info.Value, info.Stack)
+
+	if s.Config.OnPanic != nil {
+		func() {
+			defer func() {
+				if value := recover(); value != nil {
+					rlog.Errorf("OnPanic hook panicked: %v",
+						value)
+				}
+			}()
+			s.Config.OnPanic(info)
+		}()
+	}
+
+	return &RPCError{
+		Code:    ErrRPCInternal.Code,
+		Message: ErrRPCInternal.Message + " (incident " + info.IncidentID + ")",
+	}
+}
@@ -0,0 +1,223 @@
+package gorpc
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"github.com/btcsuite/btcutil"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	// defaultRPCCertFile and defaultRPCKeyFile are the certificate and key
+	// files used when TLS is enabled without specifying them.
+	defaultRPCCertFile = "rpc.cert"
+	defaultRPCKeyFile  = "rpc.key"
+
+	// defaultTLSReloadInterval is how often the certificate files are
+	// checked for changes when TLSReloadInterval is not set.
+	defaultTLSReloadInterval = 10 * time.Second
+
+	// certValidity is how long an autogenerated certificate is valid.
+	certValidity = 10 * 365 * 24 * time.Hour
+)
+
+// genCertPair generates a key/cert pair to the paths provided.
+func genCertPair(certFile, keyFile string) error {
+	rlog.Infof("Generating TLS certificates...")
+
+	org := "gorpc autogenerated cert"
+	validUntil := time.Now().Add(certValidity)
+	cert, key, err := btcutil.NewTLSCertPair(org, validUntil, nil)
+	if err != nil {
+		return err
+	}
+
+	// Write cert and key files.
+	for _, dir := range []string{filepath.Dir(certFile), filepath.Dir(keyFile)} {
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			return err
+		}
+	}
+	if err = ioutil.WriteFile(certFile, cert, 0666); err != nil {
+		return err
+	}
+	if err = ioutil.WriteFile(keyFile, key, 0600); err != nil {
+		os.Remove(certFile)
+		return err
+	}
+
+	rlog.Infof("Done generating TLS certificates")
+	return nil
+}
+
+// fileExists reports whether the named file or directory exists.
+func fileExists(name string) bool {
+	if _, err := os.Stat(name); err != nil {
+		if os.IsNotExist(err) {
+			return false
+		}
+	}
+	return true
+}
+
+// certReloader keeps the currently served certificate and client CA pool and
+// reloads them from disk on SIGHUP or when one of the files changed.  Since
+// it only swaps what the tls.Config hands out for new handshakes, the
+// listeners keep running during a reload.
+type certReloader struct {
+	certFile string
+	keyFile  string
+	caFile   string
+	base     *tls.Config
+
+	mtx      sync.RWMutex
+	config   *tls.Config
+	modTimes map[string]time.Time
+}
+
+// newCertReloader returns a certReloader for the passed files, generating a
+// self-signed key/cert pair first if neither of them exists yet.  caFile may
+// be empty, in which case client certificates are not requested.
+func newCertReloader(certFile, keyFile, caFile string) (*certReloader, error) {
+	if !fileExists(certFile) && !fileExists(keyFile) {
+		if err := genCertPair(certFile, keyFile); err != nil {
+			return nil, err
+		}
+	}
+
+	cr := &certReloader{
+		certFile: certFile,
+		keyFile:  keyFile,
+		caFile:   caFile,
+		base: &tls.Config{
+			MinVersion: tls.VersionTLS12,
+		},
+	}
+	if err := cr.reload(); err != nil {
+		return nil, err
+	}
+	return cr, nil
+}
+
+// tlsConfig returns the tls.Config to wrap the listeners with.  Every new
+// handshake picks up the most recently loaded certificate and client CAs.
+func (cr *certReloader) tlsConfig() *tls.Config {
+	config := cr.base.Clone()
+	config.GetConfigForClient = func(*tls.ClientHelloInfo) (*tls.Config, error) {
+		cr.mtx.RLock()
+		defer cr.mtx.RUnlock()
+		return cr.config, nil
+	}
+	return config
+}
+
+// reload reads the certificate, key and client CA files from disk and
+// replaces the served configuration.  The previous configuration is kept when
+// any of the files can not be loaded, and the same files are not retried
+// until they change again.
+func (cr *certReloader) reload() error {
+	modTimes := make(map[string]time.Time)
+	for _, name := range []string{cr.certFile, cr.keyFile, cr.caFile} {
+		if name == "" {
+			continue
+		}
+		fi, err := os.Stat(name)
+		if err != nil {
+			return err
+		}
+		modTimes[name] = fi.ModTime()
+	}
+
+	config, err := cr.load()
+	cr.mtx.Lock()
+	cr.modTimes = modTimes
+	if err == nil {
+		cr.config = config
+	}
+	cr.mtx.Unlock()
+	return err
+}
+
+// load builds a new tls.Config from the certificate, key and client CA files.
+func (cr *certReloader) load() (*tls.Config, error) {
+	keyPair, err := tls.LoadX509KeyPair(cr.certFile, cr.keyFile)
+	if err != nil {
+		return nil, err
+	}
+	config := cr.base.Clone()
+	config.Certificates = []tls.Certificate{keyPair}
+
+	if cr.caFile != "" {
+		pem, err := ioutil.ReadFile(cr.caFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in client "+
+				"CA file %s", cr.caFile)
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return config, nil
+}
+
+// changed reports whether any of the watched files has a different
+// modification time than when it was last loaded.
+func (cr *certReloader) changed() bool {
+	cr.mtx.RLock()
+	defer cr.mtx.RUnlock()
+	for name, modTime := range cr.modTimes {
+		fi, err := os.Stat(name)
+		if err != nil {
+			// A file being replaced may briefly be missing, wait
+			// for it to show up again.
+			continue
+		}
+		if !fi.ModTime().Equal(modTime) {
+			return true
+		}
+	}
+	return false
+}
+
+// watch reloads the certificates whenever the process receives SIGHUP or the
+// files change on disk, checking every interval.  It must be run as a
+// goroutine and returns once quit is closed.
+func (cr *certReloader) watch(interval time.Duration, quit <-chan struct{}) {
+	sighup := make(chan os.Signal, 1)
+	signal.Notify(sighup, syscall.SIGHUP)
+	defer signal.Stop(sighup)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-sighup:
+			rlog.Infof("Received SIGHUP, reloading TLS certificates")
+		case <-ticker.C:
+			if !cr.changed() {
+				continue
+			}
+			rlog.Infof("TLS certificate files changed, reloading")
+		case <-quit:
+			return
+		}
+
+		if err := cr.reload(); err != nil {
+			rlog.Errorf("Failed to reload TLS certificates, keeping "+
+				"the current ones: %v", err)
+			continue
+		}
+		rlog.Infof("TLS certificates reloaded")
+	}
+}
@@ -0,0 +1,238 @@
+package gorpc
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// writeTestCert creates a certificate for the passed common name, signed by
+// parent or self-signed when parent is nil, writes it and its key as PEM to
+// certFile and keyFile and returns them.
+func writeTestCert(t *testing.T, certFile, keyFile, name string, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey: unexpected error: %v", err)
+	}
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	if err != nil {
+		t.Fatalf("Int: unexpected error: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  parent == nil,
+		DNSNames:              []string{"localhost"},
+	}
+	if parent == nil {
+		parent, parentKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent,
+		&key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatalf("CreateCertificate: unexpected error: %v", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("ParseCertificate: unexpected error: %v", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("MarshalECPrivateKey: unexpected error: %v", err)
+	}
+
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	if err := ioutil.WriteFile(certFile, certPEM, 0600); err != nil {
+		t.Fatalf("WriteFile: unexpected error: %v", err)
+	}
+	if err := ioutil.WriteFile(keyFile, keyPEM, 0600); err != nil {
+		t.Fatalf("WriteFile: unexpected error: %v", err)
+	}
+	return cert, key
+}
+
+// servedCert returns the certificate the TLS server at addr presents for a
+// new handshake.
+func servedCert(t *testing.T, addr string) *x509.Certificate {
+	t.Helper()
+	conn, err := tls.Dial("tcp", addr, &tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatalf("Dial: unexpected error: %v", err)
+	}
+	defer conn.Close()
+	return conn.ConnectionState().PeerCertificates[0]
+}
+
+// TestTLSClientCAs ensures that with RPCClientCAs set clients without a
+// certificate are rejected and clients with one signed by a CA are accepted.
+func TestTLSClientCAs(t *testing.T) {
+	dir := t.TempDir()
+	caFile := filepath.Join(dir, "ca.cert")
+	ca, caKey := writeTestCert(t, caFile, filepath.Join(dir, "ca.key"),
+		"test ca", nil, nil)
+	clientCertFile := filepath.Join(dir, "client.cert")
+	clientKeyFile := filepath.Join(dir, "client.key")
+	writeTestCert(t, clientCertFile, clientKeyFile, "client", ca, caKey)
+	otherCertFile := filepath.Join(dir, "other.cert")
+	otherKeyFile := filepath.Join(dir, "other.key")
+	writeTestCert(t, otherCertFile, otherKeyFile, "other", nil, nil)
+
+	config := &RpcServerConfig{
+		ListenAddrs:  []string{"127.0.0.1:0"},
+		EnableTLS:    true,
+		RPCCert:      filepath.Join(dir, "rpc.cert"),
+		RPCKey:       filepath.Join(dir, "rpc.key"),
+		RPCClientCAs: caFile,
+		Registry:     newTestRegistry(t),
+	}
+	rs, err := NewRpcServer(config)
+	if err != nil {
+		t.Fatalf("NewRpcServer: unexpected error: %v", err)
+	}
+	go rs.Start()
+	defer rs.Stop()
+	addr := rs.Addrs()[0].String()
+
+	post := func(certFile, keyFile string) (*http.Response, error) {
+		tlsConfig := &tls.Config{InsecureSkipVerify: true}
+		if certFile != "" {
+			keyPair, err := tls.LoadX509KeyPair(certFile, keyFile)
+			if err != nil {
+				t.Fatalf("LoadX509KeyPair: unexpected error: %v", err)
+			}
+			tlsConfig.Certificates = []tls.Certificate{keyPair}
+		}
+		client := &http.Client{Transport: &http.Transport{
+			TLSClientConfig: tlsConfig,
+		}}
+		return client.Post("https://"+addr, "application/json",
+			strings.NewReader(`{"jsonrpc":"1.0","method":"getreadme","params":[],"id":1}`))
+	}
+
+	tests := []struct {
+		name     string
+		certFile string
+		keyFile  string
+		accept   bool
+	}{
+		{"no certificate", "", "", false},
+		{"unknown CA", otherCertFile, otherKeyFile, false},
+		{"signed by CA", clientCertFile, clientKeyFile, true},
+	}
+	for _, test := range tests {
+		resp, err := post(test.certFile, test.keyFile)
+		if !test.accept {
+			if err == nil {
+				resp.Body.Close()
+				t.Errorf("%s: expected handshake error, got status %v",
+					test.name, resp.Status)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", test.name, err)
+			continue
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Errorf("%s: unexpected status %v", test.name,
+				resp.Status)
+		}
+	}
+}
+
+// TestTLSReload ensures new handshakes use the certificate written to disk,
+// once it is noticed by the periodic check or on SIGHUP, while the listener
+// keeps running.
+func TestTLSReload(t *testing.T) {
+	// Catch SIGHUP here as well, so a signal sent before the server
+	// watches for it does not terminate the test binary.
+	sighup := make(chan os.Signal, 1)
+	signal.Notify(sighup, syscall.SIGHUP)
+	defer signal.Stop(sighup)
+
+	tests := []struct {
+		name     string
+		interval time.Duration
+		signal   bool
+	}{
+		{"file change", 10 * time.Millisecond, false},
+		{"SIGHUP", time.Hour, true},
+	}
+	for _, test := range tests {
+		dir := t.TempDir()
+		certFile := filepath.Join(dir, "rpc.cert")
+		keyFile := filepath.Join(dir, "rpc.key")
+		writeTestCert(t, certFile, keyFile, "first", nil, nil)
+
+		rs, err := NewRpcServer(&RpcServerConfig{
+			ListenAddrs:       []string{"127.0.0.1:0"},
+			EnableTLS:         true,
+			RPCCert:           certFile,
+			RPCKey:            keyFile,
+			TLSReloadInterval: test.interval,
+			Registry:          newTestRegistry(t),
+		})
+		if err != nil {
+			t.Fatalf("%s: NewRpcServer: unexpected error: %v",
+				test.name, err)
+		}
+		go rs.Start()
+		addr := rs.Addrs()[0].String()
+
+		first := servedCert(t, addr)
+		if first.Subject.CommonName != "first" {
+			t.Fatalf("%s: served %q, want %q", test.name,
+				first.Subject.CommonName, "first")
+		}
+
+		// Move the modification time forward so the change is noticed
+		// on file systems with a coarse timestamp resolution.
+		second, _ := writeTestCert(t, certFile, keyFile, "second", nil,
+			nil)
+		future := time.Now().Add(time.Minute)
+		for _, name := range []string{certFile, keyFile} {
+			if err := os.Chtimes(name, future, future); err != nil {
+				t.Fatalf("Chtimes: unexpected error: %v", err)
+			}
+		}
+
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			if test.signal {
+				syscall.Kill(os.Getpid(), syscall.SIGHUP)
+			}
+			if bytes.Equal(servedCert(t, addr).Raw, second.Raw) {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("%s: new certificate was not served",
+					test.name)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		rs.Stop()
+	}
+}
@@ -0,0 +1,426 @@
+package gorpc
+
+import (
+	"bufio"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// defaultRolesClaim is the JWT claim the roles of a principal are read from
+// when TokenAuthConfig.RolesClaim is not set.
+const defaultRolesClaim = "roles"
+
+// TokenAuthConfig is the configuration of a TokenAuthenticator.
+type TokenAuthConfig struct {
+	// HMACSecret verifies JWTs signed with HS256, HS384 or HS512.
+	HMACSecret []byte
+
+	// PublicKeys verify JWTs signed with RS256, RS384, RS512, PS256,
+	// PS384, PS512, ES256, ES384 or ES512.  The keys must be
+	// *rsa.PublicKey or *ecdsa.PublicKey values.
+	PublicKeys []crypto.PublicKey
+
+	// PublicKeyFiles are PEM files holding further public keys or
+	// certificates to verify JWTs with.
+	PublicKeyFiles []string
+
+	// Audience, when set, must be listed in the aud claim of every JWT.
+	Audience string
+
+	// Leeway is the clock skew tolerated when checking the exp and nbf
+	// claims.
+	Leeway time.Duration
+
+	// RolesClaim is the claim holding the roles of the principal, either
+	// as an array of strings or as a space-separated string.  It defaults
+	// to "roles".
+	RolesClaim string
+
+	// APIKeyFile is a file of static API keys accepted as bearer tokens.
+	// Every non-empty line that does not start with # holds a key, the
+	// name of its principal and optionally a comma-separated list of roles,
+	// separated by whitespace.
+	APIKeyFile string
+
+	// AllowAnonymous lets requests without an Authorization header through
+	// as unauthenticated clients instead of rejecting them.
+	AllowAnonymous bool
+}
+
+// TokenAuthenticator is an Authenticator validating the bearer token of the
+// Authorization header of a request.  A token is either a JWT or one of the
+// static API keys of the config.
+type TokenAuthenticator struct {
+	config     TokenAuthConfig
+	rolesClaim string
+	publicKeys []crypto.PublicKey
+
+	// apiKeys maps the SHA-256 of every API key to its principal, so the
+	// keys themselves are not kept in memory.
+	apiKeys map[[sha256.Size]byte]*Principal
+
+	// now returns the current time and is replaced in tests.
+	now func() time.Time
+}
+
+// Ensure TokenAuthenticator satisfies the Authenticator and AuthChallenger
+// interfaces.
+var (
+	_ Authenticator  = (*TokenAuthenticator)(nil)
+	_ AuthChallenger = (*TokenAuthenticator)(nil)
+)
+
+// NewTokenAuthenticator returns a TokenAuthenticator for the passed config,
+// loading the public key and API key files.
+func NewTokenAuthenticator(config *TokenAuthConfig) (*TokenAuthenticator, error) {
+	ta := &TokenAuthenticator{
+		config:     *config,
+		rolesClaim: config.RolesClaim,
+		apiKeys:    make(map[[sha256.Size]byte]*Principal),
+		now:        time.Now,
+	}
+	if ta.rolesClaim == "" {
+		ta.rolesClaim = defaultRolesClaim
+	}
+
+	for _, key := range config.PublicKeys {
+		switch key.(type) {
+		case *rsa.PublicKey, *ecdsa.PublicKey:
+		default:
+			return nil, fmt.Errorf("unsupported public key type %T", key)
+		}
+		ta.publicKeys = append(ta.publicKeys, key)
+	}
+	for _, name := range config.PublicKeyFiles {
+		keys, err := loadPublicKeys(name)
+		if err != nil {
+			return nil, err
+		}
+		ta.publicKeys = append(ta.publicKeys, keys...)
+	}
+
+	if config.APIKeyFile != "" {
+		if err := ta.loadAPIKeys(config.APIKeyFile); err != nil {
+			return nil, err
+		}
+	}
+	return ta, nil
+}
+
+// loadPublicKeys returns the RSA and ECDSA public keys of every PUBLIC KEY
+// and CERTIFICATE block in the named PEM file.
+func loadPublicKeys(name string) ([]crypto.PublicKey, error) {
+	data, err := ioutil.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+
+	var keys []crypto.PublicKey
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+
+		var key crypto.PublicKey
+		switch block.Type {
+		case "PUBLIC KEY":
+			key, err = x509.ParsePKIXPublicKey(block.Bytes)
+		case "RSA PUBLIC KEY":
+			key, err = x509.ParsePKCS1PublicKey(block.Bytes)
+		case "CERTIFICATE":
+			var cert *x509.Certificate
+			cert, err = x509.ParseCertificate(block.Bytes)
+			if err == nil {
+				key = cert.PublicKey
+			}
+		default:
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", name, err)
+		}
+		switch key.(type) {
+		case *rsa.PublicKey, *ecdsa.PublicKey:
+			keys = append(keys, key)
+		default:
+			return nil, fmt.Errorf("%s: unsupported public key type "+
+				"%T", name, key)
+		}
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("no public keys found in %s", name)
+	}
+	return keys, nil
+}
+
+// loadAPIKeys reads the static API keys from the named file.
+func (ta *TokenAuthenticator) loadAPIKeys(name string) error {
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 2 || len(fields) > 3 {
+			return fmt.Errorf("%s:%d: expected key, name and "+
+				"optional roles", name, lineNum)
+		}
+
+		principal := &Principal{Name: fields[1]}
+		if len(fields) == 3 {
+			principal.Roles = strings.Split(fields[2], ",")
+		}
+		ta.apiKeys[sha256.Sum256([]byte(fields[0]))] = principal
+	}
+	return scanner.Err()
+}
+
+// Authenticate validates the bearer token of the request and returns the
+// principal it identifies.  This is part of the Authenticator interface.
+func (ta *TokenAuthenticator) Authenticate(r *http.Request) (*Principal, error) {
+	authhdr := r.Header.Get("Authorization")
+	if authhdr == "" {
+		if ta.config.AllowAnonymous {
+			return nil, nil
+		}
+		rlog.Warnf("RPC authentication failure from %s: no bearer token",
+			r.RemoteAddr)
+		return nil, errors.New("auth failure")
+	}
+
+	const prefix = "Bearer "
+	if len(authhdr) <= len(prefix) ||
+		!strings.EqualFold(authhdr[:len(prefix)], prefix) {
+
+		rlog.Warnf("RPC authentication failure from %s: not a bearer "+
+			"token", r.RemoteAddr)
+		return nil, errors.New("auth failure")
+	}
+	token := strings.TrimSpace(authhdr[len(prefix):])
+
+	// Static API keys are looked up by their hash and never contain the
+	// dots separating the parts of a JWT.
+	if strings.Count(token, ".") != 2 {
+		principal, ok := ta.apiKeys[sha256.Sum256([]byte(token))]
+		if !ok {
+			rlog.Warnf("RPC authentication failure from %s: unknown "+
+				"API key", r.RemoteAddr)
+			return nil, errors.New("auth failure")
+		}
+		return principal, nil
+	}
+
+	principal, err := ta.verifyJWT(token)
+	if err != nil {
+		rlog.Warnf("RPC authentication failure from %s: %v",
+			r.RemoteAddr, err)
+		return nil, errors.New("auth failure")
+	}
+	return principal, nil
+}
+
+// Challenge returns the Bearer challenge of RFC 6750 for a rejected request,
+// which reports an invalid token unless the request carried none.  This is
+// part of the AuthChallenger interface.
+func (ta *TokenAuthenticator) Challenge(r *http.Request) string {
+	if r.Header.Get("Authorization") == "" {
+		return `Bearer realm="gorpc RPC"`
+	}
+	return `Bearer realm="gorpc RPC", error="invalid_token"`
+}
+
+// jwtHeader is the JOSE header of a JWT.
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Typ string `json:"typ"`
+}
+
+// verifyJWT checks the signature and the exp, nbf and aud claims of the
+// passed compact serialized JWT and returns the principal it identifies.
+func (ta *TokenAuthenticator) verifyJWT(token string) (*Principal, error) {
+	parts := strings.Split(token, ".")
+	headerJSON, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, fmt.Errorf("malformed JWT header: %v", err)
+	}
+	var header jwtHeader
+	if err := json.Unmarshal(headerJSON, &header); err != nil {
+		return nil, fmt.Errorf("malformed JWT header: %v", err)
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("malformed JWT signature: %v", err)
+	}
+
+	signed := []byte(parts[0] + "." + parts[1])
+	if err := ta.verifySignature(header.Alg, signed, sig); err != nil {
+		return nil, err
+	}
+
+	claimsJSON, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, fmt.Errorf("malformed JWT claims: %v", err)
+	}
+	var claims map[string]interface{}
+	if err := json.Unmarshal(claimsJSON, &claims); err != nil {
+		return nil, fmt.Errorf("malformed JWT claims: %v", err)
+	}
+	if err := ta.checkClaims(claims); err != nil {
+		return nil, err
+	}
+
+	principal := &Principal{Claims: claims}
+	principal.Name, _ = claims["sub"].(string)
+	switch roles := claims[ta.rolesClaim].(type) {
+	case string:
+		principal.Roles = strings.Fields(roles)
+	case []interface{}:
+		for _, role := range roles {
+			if role, ok := role.(string); ok {
+				principal.Roles = append(principal.Roles, role)
+			}
+		}
+	}
+	return principal, nil
+}
+
+// verifySignature verifies the signature of a JWT signed with the passed
+// algorithm.  Signatures made with public key algorithms are accepted when
+// any of the configured public keys of a matching type verifies them.
+func (ta *TokenAuthenticator) verifySignature(alg string, signed, sig []byte) error {
+	// Every supported algorithm is named by a two letter family followed
+	// by the size of the hash.
+	if len(alg) != 5 {
+		return fmt.Errorf("unsupported JWT algorithm %q", alg)
+	}
+	var hash crypto.Hash
+	switch alg[2:] {
+	case "256":
+		hash = crypto.SHA256
+	case "384":
+		hash = crypto.SHA384
+	case "512":
+		hash = crypto.SHA512
+	default:
+		return fmt.Errorf("unsupported JWT algorithm %q", alg)
+	}
+
+	if alg[:2] == "HS" {
+		if len(ta.config.HMACSecret) == 0 {
+			return fmt.Errorf("unsupported JWT algorithm %q", alg)
+		}
+		mac := hmac.New(hash.New, ta.config.HMACSecret)
+		mac.Write(signed)
+		if !hmac.Equal(sig, mac.Sum(nil)) {
+			return errors.New("invalid JWT signature")
+		}
+		return nil
+	}
+
+	h := hash.New()
+	h.Write(signed)
+	digest := h.Sum(nil)
+
+	for _, key := range ta.publicKeys {
+		var err error
+		switch key := key.(type) {
+		case *rsa.PublicKey:
+			switch alg[:2] {
+			case "RS":
+				err = rsa.VerifyPKCS1v15(key, hash, digest, sig)
+			case "PS":
+				err = rsa.VerifyPSS(key, hash, digest, sig, nil)
+			default:
+				continue
+			}
+		case *ecdsa.PublicKey:
+			if alg[:2] != "ES" {
+				continue
+			}
+			// The signature is the concatenation of the big-endian
+			// r and s values, each the size of the curve order.
+			size := (key.Curve.Params().BitSize + 7) / 8
+			if len(sig) != 2*size {
+				continue
+			}
+			r := new(big.Int).SetBytes(sig[:size])
+			s := new(big.Int).SetBytes(sig[size:])
+			if !ecdsa.Verify(key, digest, r, s) {
+				continue
+			}
+		default:
+			continue
+		}
+		if err == nil {
+			return nil
+		}
+	}
+	return fmt.Errorf("invalid JWT signature for algorithm %q", alg)
+}
+
+// checkClaims checks the exp, nbf and aud claims of a JWT.
+func (ta *TokenAuthenticator) checkClaims(claims map[string]interface{}) error {
+	now := ta.now()
+	leeway := ta.config.Leeway
+
+	if exp, ok := claims["exp"]; ok {
+		expSecs, ok := exp.(float64)
+		if !ok {
+			return errors.New("malformed JWT exp claim")
+		}
+		if now.Add(-leeway).After(time.Unix(int64(expSecs), 0)) {
+			return errors.New("JWT is expired")
+		}
+	}
+	if nbf, ok := claims["nbf"]; ok {
+		nbfSecs, ok := nbf.(float64)
+		if !ok {
+			return errors.New("malformed JWT nbf claim")
+		}
+		if now.Add(leeway).Before(time.Unix(int64(nbfSecs), 0)) {
+			return errors.New("JWT is not valid yet")
+		}
+	}
+
+	if ta.config.Audience == "" {
+		return nil
+	}
+	switch aud := claims["aud"].(type) {
+	case string:
+		if aud == ta.config.Audience {
+			return nil
+		}
+	case []interface{}:
+		for _, aud := range aud {
+			if aud == ta.config.Audience {
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf("JWT audience does not include %q",
+		ta.config.Audience)
+}
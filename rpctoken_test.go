@@ -0,0 +1,285 @@
+package gorpc
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"github.com/gorilla/websocket"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// signJWT returns a JWT with the passed claims signed by key using alg.  The
+// key is the HMAC secret for HS algorithms and a private key otherwise.
+func signJWT(t *testing.T, alg string, key interface{}, claims map[string]interface{}) string {
+	t.Helper()
+	enc := func(v interface{}) string {
+		b, err := json.Marshal(v)
+		if err != nil {
+			t.Fatalf("Marshal: unexpected error: %v", err)
+		}
+		return base64.RawURLEncoding.EncodeToString(b)
+	}
+	signed := enc(map[string]string{"alg": alg, "typ": "JWT"}) + "." +
+		enc(claims)
+
+	h := crypto.SHA256.New()
+	h.Write([]byte(signed))
+	digest := h.Sum(nil)
+
+	var sig []byte
+	var err error
+	switch key := key.(type) {
+	case []byte:
+		mac := hmac.New(crypto.SHA256.New, key)
+		mac.Write([]byte(signed))
+		sig = mac.Sum(nil)
+	case *rsa.PrivateKey:
+		sig, err = rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest)
+	case *ecdsa.PrivateKey:
+		r, s, e := ecdsa.Sign(rand.Reader, key, digest)
+		sig, err = make([]byte, 64), e
+		r.FillBytes(sig[:32])
+		s.FillBytes(sig[32:])
+	}
+	if err != nil {
+		t.Fatalf("sign: unexpected error: %v", err)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+// TestTokenAuthenticator ensures bearer tokens are validated and mapped to
+// principals.
+func TestTokenAuthenticator(t *testing.T) {
+	secret := []byte("secret")
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("GenerateKey: unexpected error: %v", err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey: unexpected error: %v", err)
+	}
+	otherKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey: unexpected error: %v", err)
+	}
+
+	dir := t.TempDir()
+	der, err := x509.MarshalPKIXPublicKey(&ecKey.PublicKey)
+	if err != nil {
+		t.Fatalf("MarshalPKIXPublicKey: unexpected error: %v", err)
+	}
+	keyFile := filepath.Join(dir, "jwt.pem")
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})
+	if err := ioutil.WriteFile(keyFile, keyPEM, 0600); err != nil {
+		t.Fatalf("WriteFile: unexpected error: %v", err)
+	}
+	apiKeyFile := filepath.Join(dir, "apikeys")
+	apiKeys := "# key name roles\nk3y svc operator,admin\n"
+	if err := ioutil.WriteFile(apiKeyFile, []byte(apiKeys), 0600); err != nil {
+		t.Fatalf("WriteFile: unexpected error: %v", err)
+	}
+
+	ta, err := NewTokenAuthenticator(&TokenAuthConfig{
+		HMACSecret:     secret,
+		PublicKeys:     []crypto.PublicKey{&rsaKey.PublicKey},
+		PublicKeyFiles: []string{keyFile},
+		Audience:       "gorpc",
+		APIKeyFile:     apiKeyFile,
+	})
+	if err != nil {
+		t.Fatalf("NewTokenAuthenticator: unexpected error: %v", err)
+	}
+	now := time.Unix(1600000000, 0)
+	ta.now = func() time.Time { return now }
+
+	claims := func(extra map[string]interface{}) map[string]interface{} {
+		c := map[string]interface{}{
+			"sub": "alice", "aud": []string{"other", "gorpc"},
+			"exp": now.Unix() + 60, "roles": []string{"operator"},
+		}
+		for k, v := range extra {
+			if v == nil {
+				delete(c, k)
+				continue
+			}
+			c[k] = v
+		}
+		return c
+	}
+
+	tests := []struct {
+		name  string
+		auth  string
+		valid bool
+		user  string
+		roles []string
+	}{
+		{"no header", "", false, "", nil},
+		{"basic auth", "Basic YTpi", false, "", nil},
+		{"HS256", "Bearer " + signJWT(t, "HS256", secret, claims(nil)),
+			true, "alice", []string{"operator"}},
+		{"RS256", "Bearer " + signJWT(t, "RS256", rsaKey, claims(nil)),
+			true, "alice", []string{"operator"}},
+		{"ES256", "bearer " + signJWT(t, "ES256", ecKey, claims(nil)),
+			true, "alice", []string{"operator"}},
+		{"space separated roles", "Bearer " + signJWT(t, "HS256", secret,
+			claims(map[string]interface{}{"roles": "a b"})),
+			true, "alice", []string{"a", "b"}},
+		{"wrong HMAC secret", "Bearer " + signJWT(t, "HS256",
+			[]byte("wrong"), claims(nil)), false, "", nil},
+		{"unknown key", "Bearer " + signJWT(t, "ES256", otherKey,
+			claims(nil)), false, "", nil},
+		{"algorithm mismatch", "Bearer " + signJWT(t, "RS256", ecKey,
+			claims(nil)), false, "", nil},
+		{"alg none", "Bearer " + signJWT(t, "none", secret, claims(nil)),
+			false, "", nil},
+		{"expired", "Bearer " + signJWT(t, "HS256", secret,
+			claims(map[string]interface{}{"exp": now.Unix() - 1})),
+			false, "", nil},
+		{"not valid yet", "Bearer " + signJWT(t, "HS256", secret,
+			claims(map[string]interface{}{"nbf": now.Unix() + 1})),
+			false, "", nil},
+		{"wrong audience", "Bearer " + signJWT(t, "HS256", secret,
+			claims(map[string]interface{}{"aud": "other"})),
+			false, "", nil},
+		{"missing audience", "Bearer " + signJWT(t, "HS256", secret,
+			claims(map[string]interface{}{"aud": nil})),
+			false, "", nil},
+		{"API key", "Bearer k3y", true, "svc",
+			[]string{"operator", "admin"}},
+		{"unknown API key", "Bearer nokey", false, "", nil},
+	}
+	for _, test := range tests {
+		r, _ := http.NewRequest("POST", "http://127.0.0.1", nil)
+		if test.auth != "" {
+			r.Header.Set("Authorization", test.auth)
+		}
+		principal, err := ta.Authenticate(r)
+		if (err == nil) != test.valid {
+			t.Errorf("%s: unexpected error %v", test.name, err)
+			continue
+		}
+		if !test.valid {
+			continue
+		}
+		if principal == nil || principal.Name != test.user ||
+			strings.Join(principal.Roles, ",") !=
+				strings.Join(test.roles, ",") {
+
+			t.Errorf("%s: unexpected principal %+v", test.name,
+				principal)
+		}
+	}
+}
+
+// TestTokenAuthServer ensures bearer tokens are checked on both HTTP POST and
+// the websocket upgrade, and the claims reach the handlers.
+func TestTokenAuthServer(t *testing.T) {
+	registry := newTestRegistry(t)
+	registry.RegisterContext("testwhoami", (*blockCmd)(nil), func(ctx context.Context, s *RpcServer, cmd interface{}) (interface{}, error) {
+		principal := PrincipalFromContext(ctx)
+		if principal == nil {
+			return nil, nil
+		}
+		return principal.Claims["sub"], nil
+	}, 0)
+
+	secret := []byte("secret")
+	ta, err := NewTokenAuthenticator(&TokenAuthConfig{HMACSecret: secret})
+	if err != nil {
+		t.Fatalf("NewTokenAuthenticator: unexpected error: %v", err)
+	}
+	_, addr := newTestServer(t, &RpcServerConfig{
+		Registry:      registry,
+		Authenticator: ta,
+	})
+
+	token := signJWT(t, "HS256", secret, map[string]interface{}{
+		"sub": "alice",
+	})
+	header := http.Header{"Authorization": {"Bearer " + token}}
+	body := `{"jsonrpc":"2.0","method":"testwhoami","params":[],"id":1}`
+
+	tests := []struct {
+		auth      string
+		challenge string
+	}{
+		{"", `Bearer realm="gorpc RPC"`},
+		{"Bearer bogus", `Bearer realm="gorpc RPC", error="invalid_token"`},
+		{"Bearer " + token, ""},
+	}
+	for _, test := range tests {
+		req, _ := http.NewRequest("POST", "http://"+addr,
+			strings.NewReader(body))
+		if test.auth != "" {
+			req.Header.Set("Authorization", test.auth)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Do: unexpected error: %v", err)
+		}
+		var reply struct {
+			Result string `json:"result"`
+		}
+		if resp.StatusCode == http.StatusOK {
+			err = json.NewDecoder(resp.Body).Decode(&reply)
+		}
+		resp.Body.Close()
+		if err != nil {
+			t.Fatalf("Decode: unexpected error: %v", err)
+		}
+		if test.challenge != "" {
+			if resp.StatusCode != http.StatusUnauthorized {
+				t.Errorf("%q: got status %d, want %d", test.auth,
+					resp.StatusCode, http.StatusUnauthorized)
+			}
+			got := resp.Header.Get("WWW-Authenticate")
+			if got != test.challenge {
+				t.Errorf("%q: got challenge %q, want %q",
+					test.auth, got, test.challenge)
+			}
+			continue
+		}
+		if reply.Result != "alice" {
+			t.Errorf("got result %q with token, want %q",
+				reply.Result, "alice")
+		}
+	}
+
+	_, resp, err := websocket.DefaultDialer.Dial("ws://"+addr+"/ws", nil)
+	if err == nil || resp == nil || resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("Dial: expected 401 without token, got %v", err)
+	}
+	conn, _, err := websocket.DefaultDialer.Dial("ws://"+addr+"/ws", header)
+	if err != nil {
+		t.Fatalf("Dial: unexpected error: %v", err)
+	}
+	defer conn.Close()
+	if err := conn.WriteMessage(websocket.TextMessage, []byte(body)); err != nil {
+		t.Fatalf("WriteMessage: unexpected error: %v", err)
+	}
+	var reply struct {
+		Result string `json:"result"`
+	}
+	if err := conn.ReadJSON(&reply); err != nil {
+		t.Fatalf("ReadJSON: unexpected error: %v", err)
+	}
+	if reply.Result != "alice" {
+		t.Fatalf("got result %q over websocket, want %q", reply.Result,
+			"alice")
+	}
+}
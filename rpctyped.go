@@ -0,0 +1,94 @@
+package gorpc
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+)
+
+var (
+	contextType = reflect.TypeOf((*context.Context)(nil)).Elem()
+	errorType   = reflect.TypeOf((*error)(nil)).Elem()
+)
+
+// RegisterFunc registers a typed handler in the default registry, see
+// Registry.RegisterFunc.
+func RegisterFunc(method string, handler interface{}, flags UsageFlag, opts ...RegisterOption) {
+	defaultRegistry.RegisterFunc(method, handler, flags, opts...)
+}
+
+// RegisterFunc registers a typed handler of the form
+//
+//	func(ctx context.Context, cmd *FooCmd) (*FooResult, error)
+//
+// for the passed method.  The command type is derived from the parameter, so
+// the handler receives the unmarshalled command without a type assertion, and
+// the result type is recorded, see ResultType.  Like Register it panics if the
+// handler does not have this form or the command cannot be registered.
+func (r *Registry) RegisterFunc(method string, handler interface{}, flags UsageFlag, opts ...RegisterOption) {
+	cmd, resultType, ctxHandler, err := typedHandler(handler)
+	if err != nil {
+		panic(fmt.Sprintf("failed to register type %q:%v\n", method, err))
+	}
+	opts = append(opts, func(info *methodInfo) {
+		info.resultType = resultType
+	})
+	r.mustRegister(method, cmd, flags, opts, ctxHandler, nil)
+}
+
+// typedHandler validates the signature of a typed handler and returns a nil
+// pointer of its command type, its result type and a ContextHandler calling
+// it.
+func typedHandler(handler interface{}) (interface{}, reflect.Type, ContextHandler, error) {
+	fn := reflect.ValueOf(handler)
+	if fn.Kind() != reflect.Func || fn.IsNil() {
+		str := fmt.Sprintf("handler must be a func not '%T'", handler)
+		return nil, nil, nil, makeError(ErrInvalidHandler, str)
+	}
+	ft := fn.Type()
+	if ft.IsVariadic() || ft.NumIn() != 2 || ft.NumOut() != 2 ||
+		ft.In(0) != contextType || ft.Out(1) != errorType {
+
+		str := fmt.Sprintf("handler must be func(context.Context, "+
+			"*Cmd) (Result, error) not '%v'", ft)
+		return nil, nil, nil, makeError(ErrInvalidHandler, str)
+	}
+	cmdType := ft.In(1)
+	if cmdType.Kind() != reflect.Ptr || cmdType.Elem().Kind() != reflect.Struct {
+		str := fmt.Sprintf("command parameter of handler must be "+
+			"*struct not '%v'", cmdType)
+		return nil, nil, nil, makeError(ErrInvalidHandler, str)
+	}
+
+	ctxHandler := func(ctx context.Context, s *RpcServer, cmd interface{}) (interface{}, error) {
+		out := fn.Call([]reflect.Value{
+			reflect.ValueOf(ctx),
+			reflect.ValueOf(cmd),
+		})
+		if err, _ := out[1].Interface().(error); err != nil {
+			return nil, err
+		}
+		return out[0].Interface(), nil
+	}
+	return reflect.Zero(cmdType).Interface(), ft.Out(0), ctxHandler, nil
+}
+
+// MethodResultType returns the result type of the passed method of the
+// default registry, see Registry.ResultType.
+func MethodResultType(method string) (reflect.Type, error) {
+	return defaultRegistry.ResultType(method)
+}
+
+// ResultType returns the result type of the passed method, which is nil unless
+// it was registered with RegisterFunc.  It is meant for generating
+// documentation and clients.  The method must be registered in the registry.
+func (r *Registry) ResultType(method string) (reflect.Type, error) {
+	r.mtx.RLock()
+	info, ok := r.methodToInfo[method]
+	r.mtx.RUnlock()
+	if !ok {
+		str := fmt.Sprintf("%q is not registered", method)
+		return nil, makeError(ErrUnregisteredMethod, str)
+	}
+	return info.resultType, nil
+}
@@ -0,0 +1,100 @@
+package gorpc
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+// typedCmd and typedResult are used by TestRegisterFunc.
+type typedCmd struct {
+	A int
+	B *int `jsonrpcdefault:"2"`
+}
+
+type typedResult struct {
+	Sum int `json:"sum"`
+}
+
+// TestRegisterFunc ensures typed handlers receive their command without a
+// type assertion, their result type is recorded and invalid signatures are
+// rejected.
+func TestRegisterFunc(t *testing.T) {
+	registry := NewRegistry()
+	registry.RegisterFunc("testtyped", func(ctx context.Context, cmd *typedCmd) (*typedResult, error) {
+		if cmd.A < 0 {
+			return nil, ErrRPCInvalidParams
+		}
+		return &typedResult{Sum: cmd.A + *cmd.B}, nil
+	}, 0)
+
+	resultType, err := registry.ResultType("testtyped")
+	if err != nil || resultType != reflect.TypeOf((*typedResult)(nil)) {
+		t.Errorf("ResultType: got (%v, %v)", resultType, err)
+	}
+	if method, err := registry.CmdMethod((*typedCmd)(nil)); err != nil ||
+		method != "testtyped" {
+
+		t.Errorf("CmdMethod: got (%q, %v)", method, err)
+	}
+	if _, err := registry.ResultType("testunknown"); err == nil {
+		t.Error("ResultType: expected error for unknown method")
+	}
+
+	invalid := []interface{}{
+		nil,
+		1,
+		(func(context.Context, *typedCmd) (*typedResult, error))(nil),
+		func(*typedCmd) (*typedResult, error) { return nil, nil },
+		func(context.Context, typedCmd) (*typedResult, error) { return nil, nil },
+		func(context.Context, *int) (*typedResult, error) { return nil, nil },
+		func(context.Context, *typedCmd) *typedResult { return nil },
+		func(context.Context, *typedCmd) (*typedResult, bool) { return nil, false },
+		func(context.Context, ...*typedCmd) (*typedResult, error) { return nil, nil },
+	}
+	for _, handler := range invalid {
+		_, _, _, err := typedHandler(handler)
+		var gerr Error
+		if !errors.As(err, &gerr) || gerr.ErrorCode != ErrInvalidHandler {
+			t.Errorf("typedHandler(%T): got %v, want %v", handler, err,
+				ErrInvalidHandler)
+		}
+	}
+
+	_, addr := newTestServer(t, &RpcServerConfig{Registry: registry})
+	tests := []struct {
+		params string
+		sum    int
+		code   RPCErrorCode
+	}{
+		{"[1]", 3, 0},
+		{"[1,5]", 6, 0},
+		{"[-1]", 0, ErrRPCInvalidParams.Code},
+	}
+	for _, test := range tests {
+		reply := postJSON(t, addr, `{"jsonrpc":"2.0","method":"testtyped","params":`+
+			test.params+`,"id":1}`)
+		var resp struct {
+			Result *typedResult `json:"result"`
+			Error  *RPCError    `json:"error"`
+		}
+		if err := json.Unmarshal(reply, &resp); err != nil {
+			t.Fatalf("Unmarshal: unexpected error: %v", err)
+		}
+		if test.code != 0 {
+			if resp.Error == nil || resp.Error.Code != test.code {
+				t.Errorf("%s: got reply %s, want code %d",
+					test.params, reply, test.code)
+			}
+			continue
+		}
+		if resp.Error != nil || resp.Result == nil ||
+			resp.Result.Sum != test.sum {
+
+			t.Errorf("%s: got reply %s, want sum %d", test.params,
+				reply, test.sum)
+		}
+	}
+}
@@ -1 +1,643 @@
-package gorpc
\ No newline at end of file
+package gorpc
+
+import (
+	"container/list"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gorilla/websocket"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// websocketSendBufferSize is the number of replies the send channel
+	// of each client can queue before request goroutines block.
+	websocketSendBufferSize = 50
+
+	// websocketWriteWait is the time allowed to write a message to the
+	// peer.
+	websocketWriteWait = 10 * time.Second
+
+	// websocketPongWait is the time allowed to read the next pong message
+	// from the peer.
+	websocketPongWait = 60 * time.Second
+
+	// websocketPingPeriod is the interval pings are sent to the peer.  It
+	// must be less than websocketPongWait.
+	websocketPingPeriod = (websocketPongWait * 9) / 10
+
+	// defaultWebsocketMaxConcurrentReqs is the number of requests of a
+	// client handled concurrently when WebsocketMaxConcurrentReqs is not
+	// set.
+	defaultWebsocketMaxConcurrentReqs = 20
+)
+
+// wsCommandHandler describes a callback function used to handle a specific
+// command received over a websocket.  Unlike commandHandler it also receives
+// the client the command came from, for example to subscribe it to a topic.
+type wsCommandHandler func(*RpcServer, *WsClient, interface{}, <-chan struct{}) (interface{}, error)
+
+// WsContextHandler describes a callback function used to handle a specific
+// command received over a websocket.  Like ContextHandler it receives a
+// context carrying the RequestInfo, which is cancelled when the client
+// disconnects, the server shuts down or the timeout of the method expires.
+type WsContextHandler func(ctx context.Context, s *RpcServer, c *WsClient, cmd interface{}) (interface{}, error)
+
+// AddWsHandler adds a handler for a command that can only be used over
+// websockets.
+func AddWsHandler(method string, handler wsCommandHandler) {
+	defaultRegistry.AddWsHandler(method, handler)
+}
+
+// AddWsHandler adds a handler for a command that can only be used over
+// websockets to the registry.
+func (r *Registry) AddWsHandler(method string, handler wsCommandHandler) {
+	r.AddWsContextHandler(method, adaptWsHandler(handler))
+}
+
+// AddWsContextHandler adds a handler receiving a context.Context for a command
+// that can only be used over websockets.
+func AddWsContextHandler(method string, handler WsContextHandler) {
+	defaultRegistry.AddWsContextHandler(method, handler)
+}
+
+// AddWsContextHandler adds a handler receiving a context.Context for a command
+// that can only be used over websockets to the registry.  Websocket clients
+// are notified when the method could not be called before.  A nil handler is
+// ignored.
+func (r *Registry) AddWsContextHandler(method string, handler WsContextHandler) {
+	if handler == nil {
+		return
+	}
+	r.updateMethod(method, func() error {
+		r.wsHandlers[method] = handler
+		return nil
+	})
+}
+
+// wsHandler returns the websocket handler of the passed method.
+func (r *Registry) wsHandler(method string) (WsContextHandler, bool) {
+	r.mtx.RLock()
+	defer r.mtx.RUnlock()
+	handler, ok := r.wsHandlers[method]
+	return handler, ok
+}
+
+// adaptWsHandler returns a WsContextHandler running a websocket handler with
+// the old signature, whose closeChan is closed once the context is cancelled.
+// It returns nil for a nil handler.
+func adaptWsHandler(handler wsCommandHandler) WsContextHandler {
+	if handler == nil {
+		return nil
+	}
+	return func(ctx context.Context, s *RpcServer, c *WsClient, cmd interface{}) (interface{}, error) {
+		return handler(s, c, cmd, ctx.Done())
+	}
+}
+
+// ErrClientQuit describes the error where a client send is not processed due
+// to the client having already been disconnected or dropped.
+var ErrClientQuit = errors.New("client quit")
+
+// WsClient provides an abstraction for handling a websocket client.  The
+// overall data flow is split into 3 main goroutines, inHandler, outHandler
+// and notificationQueueHandler.  The inHandler reads JSON-RPC requests off the
+// socket and runs every request in its own goroutine, while the outHandler is
+// the only writer to the socket and drains the send queue filled by the
+// request goroutines.  The notificationQueueHandler queues notifications
+// without bounds so publishing never blocks on a slow client.
+type WsClient struct {
+	sync.Mutex
+
+	// server is the RPC server that is servicing the client.
+	server *RpcServer
+
+	// conn is the underlying websocket connection.
+	conn *websocket.Conn
+
+	// disconnected indicated whether or not the websocket client is
+	// disconnected.
+	disconnected bool
+
+	// addr is the remote address of the client.
+	addr string
+
+	// principal is the identity the client authenticated as during the
+	// websocket upgrade, nil for unauthenticated clients.
+	principal *Principal
+
+	// topics are the notification topics the client is subscribed to.  It
+	// is protected by the ntfnLock of the server.
+	topics map[string]struct{}
+
+	// serviceRequestSem bounds the number of requests of the client that
+	// are handled concurrently.
+	serviceRequestSem chan struct{}
+
+	sendChan chan []byte
+	ntfnChan chan []byte
+	quit     chan struct{}
+	wg       sync.WaitGroup
+}
+
+// newWebsocketClient returns a new websocket client given the server and the
+// upgraded connection.
+func newWebsocketClient(server *RpcServer, conn *websocket.Conn, remoteAddr string, principal *Principal) *WsClient {
+	return &WsClient{
+		server:    server,
+		conn:      conn,
+		addr:      remoteAddr,
+		principal: principal,
+		topics:    make(map[string]struct{}),
+		sendChan:  make(chan []byte, websocketSendBufferSize),
+		ntfnChan:  make(chan []byte),
+		quit:      make(chan struct{}),
+		serviceRequestSem: make(chan struct{},
+			server.websocketMaxConcurrentReqs()),
+	}
+}
+
+// websocketMaxConcurrentReqs returns the number of requests of a websocket
+// client that are handled concurrently.
+func (rs *RpcServer) websocketMaxConcurrentReqs() int {
+	if rs.Config.WebsocketMaxConcurrentReqs > 0 {
+		return rs.Config.WebsocketMaxConcurrentReqs
+	}
+	return defaultWebsocketMaxConcurrentReqs
+}
+
+// WebsocketHandler upgrades the connection to a websocket and serves JSON-RPC
+// requests on it until the client disconnects or the server is stopped.
+func (rs *RpcServer) WebsocketHandler(w http.ResponseWriter, r *http.Request) {
+	// 认证失败的客户端按IP限流，在检查认证信息之前拒绝
+	if err := rs.allowAuth(r.RemoteAddr); err != nil {
+		jsonRateLimited(w, err)
+		return
+	}
+
+	// 在升级之前检查用户认证信息
+	principal, err := rs.authenticate(r)
+	if err != nil {
+		rs.authFailed(r.RemoteAddr)
+		jsonAuthFail(w, rs.authChallenge(r))
+		return
+	}
+
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		if _, ok := err.(websocket.HandshakeError); !ok {
+			rlog.Errorf("Unexpected websocket error: %v", err)
+		}
+		return
+	}
+	rlog.Infof("New websocket client %s", r.RemoteAddr)
+
+	client := newWebsocketClient(rs, conn, r.RemoteAddr, principal)
+	if !rs.addWebsocketClient(client) {
+		rlog.Warnf("Rejecting websocket client %s: server is shutting "+
+			"down", r.RemoteAddr)
+		conn.Close()
+		return
+	}
+	client.start()
+	client.waitForShutdown()
+	rs.removeWebsocketClient(client)
+	rs.unsubscribeAll(client)
+	rlog.Infof("Disconnected websocket client %s", r.RemoteAddr)
+}
+
+// addWebsocketClient registers a connected websocket client so it can be
+// disconnected by Stop.  It returns false when the server is shutting down.
+func (rs *RpcServer) addWebsocketClient(client *WsClient) bool {
+	rs.activeLock.Lock()
+	defer rs.activeLock.Unlock()
+	if atomic.LoadInt32(&rs.shutdown) != 0 {
+		return false
+	}
+	rs.wsClients[client] = struct{}{}
+	return true
+}
+
+// removeWebsocketClient removes a disconnected websocket client.
+func (rs *RpcServer) removeWebsocketClient(client *WsClient) {
+	rs.activeLock.Lock()
+	delete(rs.wsClients, client)
+	rs.activeLock.Unlock()
+}
+
+// disconnectWebsocketClients disconnects every connected websocket client.
+func (rs *RpcServer) disconnectWebsocketClients() {
+	rs.activeLock.Lock()
+	clients := make([]*WsClient, 0, len(rs.wsClients))
+	for client := range rs.wsClients {
+		clients = append(clients, client)
+	}
+	rs.activeLock.Unlock()
+
+	for _, client := range clients {
+		client.Disconnect()
+	}
+}
+
+// inHandler handles all incoming messages for the websocket connection.  It
+// must be run as a goroutine.
+func (c *WsClient) inHandler() {
+	c.conn.SetReadLimit(c.server.maxRequestBodySize())
+	c.conn.SetReadDeadline(time.Now().Add(websocketPongWait))
+	c.conn.SetPongHandler(func(string) error {
+		c.conn.SetReadDeadline(time.Now().Add(websocketPongWait))
+		return nil
+	})
+
+out:
+	for {
+		_, msg, err := c.conn.ReadMessage()
+		if err != nil {
+			// Log the error if it's not due to disconnecting.
+			if !c.Disconnected() && websocket.IsUnexpectedCloseError(err,
+				websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+				rlog.Errorf("Websocket receive error from %s: %v",
+					c.addr, err)
+			}
+			break out
+		}
+
+		var request Request
+		if err := unmarshalRequest(msg, &request); err != nil {
+			reply, err := invalidRequestReply(msg, err, RPCVersion1)
+			if err != nil {
+				rlog.Errorf("Failed to marshal parse failure reply: %v", err)
+				continue
+			}
+			c.SendMessage(reply)
+			continue
+		}
+
+		// Stop reading further messages while the client already has
+		// the maximum number of requests in flight.
+		select {
+		case c.serviceRequestSem <- struct{}{}:
+		case <-c.quit:
+			break out
+		}
+		c.wg.Add(1)
+		go c.handleRequest(&request)
+	}
+
+	// Ensure the connection is closed.
+	c.Disconnect()
+	c.wg.Done()
+	rlog.Tracef("Websocket client input handler done for %s", c.addr)
+}
+
+// handleRequest runs the handler of a single request and queues the reply.
+// Requests of the same client run concurrently, the reply is tagged with the
+// request id so the client can match it.  It must be run as a goroutine after
+// acquiring serviceRequestSem, which it releases.
+func (c *WsClient) handleRequest(request *Request) {
+	defer c.wg.Done()
+	defer func() { <-c.serviceRequestSem }()
+
+	var result interface{}
+	var jsonErr error
+	activeReq := c.server.trackRequest(&RequestInfo{
+		RemoteAddr: c.addr,
+		Principal:  c.principal,
+		Transport:  TransportWebsocket,
+	})
+	if activeReq == nil {
+		jsonErr = &RPCError{
+			Code:    ErrRPCInternal.Code,
+			Message: "Server is shutting down",
+		}
+	} else {
+		defer c.server.untrackRequest(activeReq)
+		c.server.setRequestInfo(activeReq, request.ID, request.Method)
+
+		// Abort the handler when the client disconnects.
+		done := make(chan struct{})
+		defer close(done)
+		go func() {
+			select {
+			case <-c.quit:
+				activeReq.close()
+			case <-done:
+			}
+		}()
+
+		ctx, cancel := requestContext(activeReq.ctx, request)
+		defer cancel()
+		var parsedCmd *ParsedRPCCmd
+		if err := c.server.allowRequest(c.principal, c.addr); err != nil {
+			jsonErr = err
+		} else if err := c.server.authorize(request.Method, c.principal); err != nil {
+			jsonErr = err
+		} else if parsedCmd = c.server.parseCmd(request); parsedCmd.Err != nil {
+			jsonErr = parsedCmd.Err
+		} else if wsHandler, ok := c.server.registry.wsHandler(parsedCmd.Method); ok {
+			result, jsonErr = c.server.wsCmdResult(ctx, c, wsHandler,
+				parsedCmd)
+		} else {
+			result, jsonErr = c.server.standardCmdResult(ctx,
+				parsedCmd)
+		}
+	}
+
+	// 通知也要执行，但是不能回复
+	if c.server.isNotification(request) {
+		return
+	}
+
+	reply, err := createMarshalledReply(request.Jsonrpc, request.ID, result,
+		jsonErr)
+	if err != nil {
+		rlog.Errorf("Failed to marshal reply for <%s> command: %v",
+			request.Method, err)
+		return
+	}
+	c.SendMessage(reply)
+}
+
+// wsCmdResult runs the websocket handler of a parsed command.  The handler is
+// signalled to abort once ctx is cancelled or its timeout expired.
+func (rs *RpcServer) wsCmdResult(ctx context.Context, c *WsClient, handler WsContextHandler, cmd *ParsedRPCCmd) (interface{}, error) {
+	return rs.runHandler(ctx, cmd.Method, func(ctx context.Context) (interface{}, error) {
+		return handler(ctx, rs, c, cmd.Cmd)
+	})
+}
+
+// outHandler handles all outgoing messages for the websocket connection and
+// keeps it alive with pings.  It must be run as a goroutine.
+func (c *WsClient) outHandler() {
+	ticker := time.NewTicker(websocketPingPeriod)
+	defer ticker.Stop()
+
+out:
+	for {
+		select {
+		case msg := <-c.sendChan:
+			c.conn.SetWriteDeadline(time.Now().Add(websocketWriteWait))
+			err := c.conn.WriteMessage(websocket.TextMessage, msg)
+			if err != nil {
+				c.Disconnect()
+				break out
+			}
+
+		case <-ticker.C:
+			c.conn.SetWriteDeadline(time.Now().Add(websocketWriteWait))
+			err := c.conn.WriteMessage(websocket.PingMessage, nil)
+			if err != nil {
+				c.Disconnect()
+				break out
+			}
+
+		case <-c.quit:
+			break out
+		}
+	}
+
+	c.wg.Done()
+	rlog.Tracef("Websocket client output handler done for %s", c.addr)
+}
+
+// notificationQueueHandler handles the queuing of outgoing notifications for
+// the websocket client.  Notifications are kept in an unbounded queue and
+// passed on to the send channel as the outHandler drains it.  It must be run
+// as a goroutine.
+func (c *WsClient) notificationQueueHandler() {
+	pendingNtfns := list.New()
+
+out:
+	for {
+		// Only try to hand over a notification when one is queued.
+		var sendChan chan []byte
+		var next []byte
+		if e := pendingNtfns.Front(); e != nil {
+			sendChan = c.sendChan
+			next = e.Value.([]byte)
+		}
+
+		select {
+		case n := <-c.ntfnChan:
+			pendingNtfns.PushBack(n)
+
+		case sendChan <- next:
+			pendingNtfns.Remove(pendingNtfns.Front())
+
+		case <-c.quit:
+			break out
+		}
+	}
+
+	c.wg.Done()
+	rlog.Tracef("Websocket client notification queue handler done for %s",
+		c.addr)
+}
+
+// QueueNotification queues the passed notification to be sent to the
+// websocket client.  Unlike SendMessage it never blocks on a full send queue.
+// It returns ErrClientQuit if the client has been disconnected.
+func (c *WsClient) QueueNotification(marshalledJSON []byte) error {
+	select {
+	case c.ntfnChan <- marshalledJSON:
+		return nil
+	case <-c.quit:
+		return ErrClientQuit
+	}
+}
+
+// Principal returns the principal the client authenticated as during the
+// websocket upgrade, nil for unauthenticated clients.
+func (c *WsClient) Principal() *Principal {
+	return c.principal
+}
+
+// Addr returns the remote address of the websocket client.
+func (c *WsClient) Addr() string {
+	return c.addr
+}
+
+// Subscribe registers the client for notifications published to topic.
+func (c *WsClient) Subscribe(topic string) {
+	c.server.ntfnLock.Lock()
+	defer c.server.ntfnLock.Unlock()
+
+	clients, ok := c.server.subscriptions[topic]
+	if !ok {
+		clients = make(map[*WsClient]struct{})
+		c.server.subscriptions[topic] = clients
+	}
+	clients[c] = struct{}{}
+	c.topics[topic] = struct{}{}
+}
+
+// Unsubscribe removes the client from the subscribers of topic.
+func (c *WsClient) Unsubscribe(topic string) {
+	c.server.ntfnLock.Lock()
+	c.server.unsubscribe(c, topic)
+	c.server.ntfnLock.Unlock()
+}
+
+// unsubscribe removes the client from the subscribers of topic.  It must be
+// called with the ntfnLock held.
+func (rs *RpcServer) unsubscribe(c *WsClient, topic string) {
+	if clients, ok := rs.subscriptions[topic]; ok {
+		delete(clients, c)
+		if len(clients) == 0 {
+			delete(rs.subscriptions, topic)
+		}
+	}
+	delete(c.topics, topic)
+}
+
+// unsubscribeAll removes the client from every topic it subscribed to.  It is
+// called once the client disconnected.
+func (rs *RpcServer) unsubscribeAll(c *WsClient) {
+	rs.ntfnLock.Lock()
+	defer rs.ntfnLock.Unlock()
+	for topic := range c.topics {
+		rs.unsubscribe(c, topic)
+	}
+}
+
+// methodsChangedMethod is the method of the notification sent to websocket
+// clients when the methods of the registry of the server change.
+const methodsChangedMethod = "methodschanged"
+
+// MethodsChangedNtfn is the param of the methodschanged notification.
+type MethodsChangedNtfn struct {
+	Added   []string `json:"added,omitempty"`
+	Removed []string `json:"removed,omitempty"`
+}
+
+// notifyMethodsChanged queues a methodschanged notification for every
+// websocket client of the passed servers.
+func notifyMethodsChanged(servers []*RpcServer, added, removed []string) {
+	if len(servers) == 0 || len(added)+len(removed) == 0 {
+		return
+	}
+	sort.Strings(added)
+	sort.Strings(removed)
+	ntfn := MethodsChangedNtfn{Added: added, Removed: removed}
+	request, err := NewRequest(nil, methodsChangedMethod,
+		[]interface{}{ntfn})
+	if err != nil {
+		rlog.Errorf("Failed to create %s notification: %v",
+			methodsChangedMethod, err)
+		return
+	}
+	marshalledJSON, err := json.Marshal(request)
+	if err != nil {
+		rlog.Errorf("Failed to marshal %s notification: %v",
+			methodsChangedMethod, err)
+		return
+	}
+
+	for _, rs := range servers {
+		rs.activeLock.Lock()
+		clients := make([]*WsClient, 0, len(rs.wsClients))
+		for client := range rs.wsClients {
+			clients = append(clients, client)
+		}
+		rs.activeLock.Unlock()
+
+		for _, client := range clients {
+			client.QueueNotification(marshalledJSON)
+		}
+	}
+}
+
+// Publish marshals the passed notification and queues it for every websocket
+// client subscribed to topic.  The notification must be a registered command
+// flagged with UFNotification and is sent as a JSON-RPC request with a null
+// id.  It returns the number of clients the notification was queued for.
+func (rs *RpcServer) Publish(topic string, ntfn interface{}) (int, error) {
+	method, err := rs.registry.CmdMethod(ntfn)
+	if err != nil {
+		return 0, err
+	}
+	flags, err := rs.registry.MethodUsageFlags(method)
+	if err != nil {
+		return 0, err
+	}
+	if flags&UFNotification == 0 {
+		str := fmt.Sprintf("method %q is not a notification", method)
+		return 0, makeError(ErrInvalidType, str)
+	}
+	marshalledJSON, err := rs.registry.MarshalCmd(nil, ntfn)
+	if err != nil {
+		return 0, err
+	}
+
+	rs.ntfnLock.Lock()
+	clients := make([]*WsClient, 0, len(rs.subscriptions[topic]))
+	for client := range rs.subscriptions[topic] {
+		clients = append(clients, client)
+	}
+	rs.ntfnLock.Unlock()
+
+	sent := 0
+	for _, client := range clients {
+		if err := client.QueueNotification(marshalledJSON); err == nil {
+			sent++
+		}
+	}
+	return sent, nil
+}
+
+// SendMessage queues the passed message to be sent to the websocket client.
+// It blocks while the send queue is full and drops the message once the
+// client disconnected.
+func (c *WsClient) SendMessage(msg []byte) {
+	select {
+	case c.sendChan <- msg:
+	case <-c.quit:
+	}
+}
+
+// Disconnected returns whether or not the websocket client is disconnected.
+func (c *WsClient) Disconnected() bool {
+	c.Lock()
+	isDisconnected := c.disconnected
+	c.Unlock()
+
+	return isDisconnected
+}
+
+// Disconnect disconnects the websocket client.
+func (c *WsClient) Disconnect() {
+	c.Lock()
+	defer c.Unlock()
+
+	// Nothing to do if already disconnected.
+	if c.disconnected {
+		return
+	}
+
+	rlog.Tracef("Disconnecting websocket client %s", c.addr)
+	close(c.quit)
+	c.conn.Close()
+	c.disconnected = true
+}
+
+// start begins processing input and output messages.
+func (c *WsClient) start() {
+	rlog.Tracef("Starting websocket client %s", c.addr)
+
+	// Start processing input and output.
+	c.wg.Add(3)
+	go c.inHandler()
+	go c.notificationQueueHandler()
+	go c.outHandler()
+}
+
+// waitForShutdown blocks until the websocket client goroutines are stopped
+// and the connection is closed.
+func (c *WsClient) waitForShutdown() {
+	c.wg.Wait()
+}
@@ -0,0 +1,412 @@
+package gorpc
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/gorilla/websocket"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newTestRegistry returns a registry holding the builtin commands only, so
+// tests register their methods without touching the default registry.
+func newTestRegistry(t *testing.T) *Registry {
+	t.Helper()
+	registry := NewRegistry()
+	if err := registry.RegisterBuiltins(); err != nil {
+		t.Fatalf("RegisterBuiltins: unexpected error: %v", err)
+	}
+	return registry
+}
+
+// newTestServer starts an RPC server on an ephemeral localhost port and
+// returns it along with its address.  Unless the config has a registry the
+// server gets a fresh one from newTestRegistry.  The server is stopped when
+// the test finishes.
+func newTestServer(t *testing.T, config *RpcServerConfig) (*RpcServer, string) {
+	t.Helper()
+	config.ListenAddrs = []string{"127.0.0.1:0"}
+	if config.Registry == nil {
+		config.Registry = newTestRegistry(t)
+	}
+	rs, err := NewRpcServer(config)
+	if err != nil {
+		t.Fatalf("NewRpcServer: unexpected error: %v", err)
+	}
+	go rs.Start()
+	t.Cleanup(func() { rs.Stop() })
+	return rs, rs.Addrs()[0].String()
+}
+
+// TestWebsocket ensures requests sent over a websocket are answered with
+// replies carrying the request id.
+func TestWebsocket(t *testing.T) {
+	_, addr := newTestServer(t, &RpcServerConfig{})
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws://"+addr+"/ws", nil)
+	if err != nil {
+		t.Fatalf("Dial: unexpected error: %v", err)
+	}
+	defer conn.Close()
+
+	for _, id := range []int{1, 2} {
+		err := conn.WriteJSON(map[string]interface{}{
+			"jsonrpc": "1.0", "method": "getreadme",
+			"params": []interface{}{}, "id": id,
+		})
+		if err != nil {
+			t.Fatalf("WriteJSON: unexpected error: %v", err)
+		}
+	}
+
+	seen := make(map[float64]bool)
+	for i := 0; i < 2; i++ {
+		var reply struct {
+			Result GetReadMeReasult `json:"result"`
+			Error  *RPCError        `json:"error"`
+			ID     float64          `json:"id"`
+		}
+		if err := conn.ReadJSON(&reply); err != nil {
+			t.Fatalf("ReadJSON: unexpected error: %v", err)
+		}
+		if reply.Error != nil || reply.Result.Info == "" {
+			t.Fatalf("unexpected reply %+v", reply)
+		}
+		seen[reply.ID] = true
+	}
+	if !seen[1] || !seen[2] {
+		t.Fatalf("replies are missing ids: %v", seen)
+	}
+
+	// A malformed request is answered with a parse error.
+	if err := conn.WriteMessage(websocket.TextMessage, []byte("{")); err != nil {
+		t.Fatalf("WriteMessage: unexpected error: %v", err)
+	}
+	var reply map[string]json.RawMessage
+	if err := conn.ReadJSON(&reply); err != nil {
+		t.Fatalf("ReadJSON: unexpected error: %v", err)
+	}
+	if string(reply["error"]) == "null" {
+		t.Fatalf("expected error reply, got %v", reply)
+	}
+}
+
+// TestWebsocketMaxConcurrentReqs ensures a websocket client can not have more
+// than WebsocketMaxConcurrentReqs requests in flight.
+func TestWebsocketMaxConcurrentReqs(t *testing.T) {
+	var active, maxActive int32
+	started := make(chan struct{}, 3)
+	release := make(chan struct{})
+	registry := newTestRegistry(t)
+	registry.Register("testwsblock", (*blockCmd)(nil), func(s *RpcServer, cmd interface{}, closeChan <-chan struct{}) (interface{}, error) {
+		n := atomic.AddInt32(&active, 1)
+		for {
+			max := atomic.LoadInt32(&maxActive)
+			if n <= max || atomic.CompareAndSwapInt32(&maxActive, max, n) {
+				break
+			}
+		}
+		started <- struct{}{}
+		<-release
+		atomic.AddInt32(&active, -1)
+		return nil, nil
+	}, 0)
+	_, addr := newTestServer(t, &RpcServerConfig{
+		Registry:                   registry,
+		WebsocketMaxConcurrentReqs: 2,
+	})
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws://"+addr+"/ws", nil)
+	if err != nil {
+		t.Fatalf("Dial: unexpected error: %v", err)
+	}
+	defer conn.Close()
+	for id := 1; id <= 3; id++ {
+		err := conn.WriteJSON(map[string]interface{}{
+			"jsonrpc": "2.0", "method": "testwsblock",
+			"params": []interface{}{}, "id": id,
+		})
+		if err != nil {
+			t.Fatalf("WriteJSON: unexpected error: %v", err)
+		}
+	}
+
+	<-started
+	<-started
+	select {
+	case <-started:
+		t.Fatal("third request started while two were in flight")
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(release)
+	for i := 0; i < 3; i++ {
+		var reply struct {
+			Error *RPCError `json:"error"`
+		}
+		if err := conn.ReadJSON(&reply); err != nil {
+			t.Fatalf("ReadJSON: unexpected error: %v", err)
+		}
+		if reply.Error != nil {
+			t.Fatalf("unexpected error reply %v", reply.Error)
+		}
+	}
+	if max := atomic.LoadInt32(&maxActive); max != 2 {
+		t.Fatalf("got %d concurrent requests, want 2", max)
+	}
+}
+
+// TestWsContextHandler ensures websocket handlers registered with
+// RegisterWsContext receive the RequestInfo and the deadline of the request.
+func TestWsContextHandler(t *testing.T) {
+	registry := newTestRegistry(t)
+	registry.RegisterWsContext("testwsrequestinfo", (*blockCmd)(nil), func(ctx context.Context, s *RpcServer, c *WsClient, cmd interface{}) (interface{}, error) {
+		info, ok := RequestInfoFromContext(ctx)
+		if !ok {
+			return nil, errors.New("no request info")
+		}
+		_, hasDeadline := ctx.Deadline()
+		return []interface{}{info.ID, info.Method, info.Transport,
+			hasDeadline}, nil
+	}, 0, WithTimeout(time.Minute))
+	_, addr := newTestServer(t, &RpcServerConfig{Registry: registry})
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws://"+addr+"/ws", nil)
+	if err != nil {
+		t.Fatalf("Dial: unexpected error: %v", err)
+	}
+	defer conn.Close()
+	err = conn.WriteMessage(websocket.TextMessage, []byte(
+		`{"jsonrpc":"2.0","method":"testwsrequestinfo","params":[],"id":7}`))
+	if err != nil {
+		t.Fatalf("WriteMessage: unexpected error: %v", err)
+	}
+	_, reply, err := conn.ReadMessage()
+	if err != nil {
+		t.Fatalf("ReadMessage: unexpected error: %v", err)
+	}
+	want := `{"jsonrpc":"2.0","result":[7,"testwsrequestinfo","websocket",true],"id":7}`
+	if got := strings.TrimSpace(string(reply)); got != want {
+		t.Errorf("got reply %s, want %s", got, want)
+	}
+}
+
+// testSubscribeCmd and testBlockNtfn are used by TestNotifications.
+type testSubscribeCmd struct {
+	Topic string
+}
+
+type testBlockNtfn struct {
+	Height int
+	Hash   *string
+}
+
+// TestNotifications ensures published notifications reach subscribed clients
+// only and subscriptions are removed when the client disconnects.
+func TestNotifications(t *testing.T) {
+	registry := newTestRegistry(t)
+	registry.RegisterWs("testsubscribe", (*testSubscribeCmd)(nil), func(s *RpcServer, c *WsClient, cmd interface{}, closeChan <-chan struct{}) (interface{}, error) {
+		c.Subscribe(cmd.(*testSubscribeCmd).Topic)
+		return nil, nil
+	}, 0)
+	registry.MustRegisterCmd("testblockconnected", (*testBlockNtfn)(nil), UFNotification)
+
+	rs, addr := newTestServer(t, &RpcServerConfig{Registry: registry})
+	conn, _, err := websocket.DefaultDialer.Dial("ws://"+addr+"/ws", nil)
+	if err != nil {
+		t.Fatalf("Dial: unexpected error: %v", err)
+	}
+	defer conn.Close()
+
+	err = conn.WriteJSON(map[string]interface{}{
+		"jsonrpc": "1.0", "method": "testsubscribe",
+		"params": []interface{}{"blocks"}, "id": 1,
+	})
+	if err != nil {
+		t.Fatalf("WriteJSON: unexpected error: %v", err)
+	}
+	var reply map[string]json.RawMessage
+	if err := conn.ReadJSON(&reply); err != nil {
+		t.Fatalf("ReadJSON: unexpected error: %v", err)
+	}
+	if string(reply["error"]) != "null" {
+		t.Fatalf("subscribe failed: %s", reply["error"])
+	}
+
+	if _, err := rs.Publish("blocks", &GetReadMeCmd{}); err == nil {
+		t.Fatal("Publish: expected error for a non-notification")
+	}
+	if n, err := rs.Publish("other", &testBlockNtfn{Height: 1}); err != nil || n != 0 {
+		t.Fatalf("Publish: got (%d, %v), want (0, nil)", n, err)
+	}
+	if n, err := rs.Publish("blocks", &testBlockNtfn{Height: 2}); err != nil || n != 1 {
+		t.Fatalf("Publish: got (%d, %v), want (1, nil)", n, err)
+	}
+
+	var ntfn Request
+	if err := conn.ReadJSON(&ntfn); err != nil {
+		t.Fatalf("ReadJSON: unexpected error: %v", err)
+	}
+	if ntfn.ID != nil || ntfn.Method != "testblockconnected" ||
+		len(ntfn.Params) != 1 || string(ntfn.Params[0]) != "2" {
+		t.Fatalf("unexpected notification %+v", ntfn)
+	}
+
+	conn.Close()
+	for i := 0; i < 100; i++ {
+		rs.ntfnLock.Lock()
+		n := len(rs.subscriptions)
+		rs.ntfnLock.Unlock()
+		if n == 0 {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("subscriptions were not cleaned up on disconnect")
+}
+
+// testDynamicCmd is used by TestMethodsChanged.
+type testDynamicCmd struct{}
+
+// TestMethodsChanged ensures methods can be registered and unregistered while
+// the server is running and websocket clients are notified of the changes.
+func TestMethodsChanged(t *testing.T) {
+	registry := NewRegistry()
+	_, addr := newTestServer(t, &RpcServerConfig{Registry: registry})
+	conn, _, err := websocket.DefaultDialer.Dial("ws://"+addr+"/ws", nil)
+	if err != nil {
+		t.Fatalf("Dial: unexpected error: %v", err)
+	}
+	defer conn.Close()
+
+	call := func() *RPCError {
+		err := conn.WriteJSON(map[string]interface{}{
+			"jsonrpc": "2.0", "method": "testdynamic",
+			"params": []interface{}{}, "id": 1,
+		})
+		if err != nil {
+			t.Fatalf("WriteJSON: unexpected error: %v", err)
+		}
+		var reply struct {
+			Error *RPCError `json:"error"`
+		}
+		if err := conn.ReadJSON(&reply); err != nil {
+			t.Fatalf("ReadJSON: unexpected error: %v", err)
+		}
+		return reply.Error
+	}
+	readNtfn := func() MethodsChangedNtfn {
+		var ntfn Request
+		if err := conn.ReadJSON(&ntfn); err != nil {
+			t.Fatalf("ReadJSON: unexpected error: %v", err)
+		}
+		var changed MethodsChangedNtfn
+		if ntfn.Method != methodsChangedMethod || len(ntfn.Params) != 1 ||
+			json.Unmarshal(ntfn.Params[0], &changed) != nil {
+
+			t.Fatalf("unexpected notification %+v", ntfn)
+		}
+		return changed
+	}
+
+	// The reply ensures the client is connected before the registry
+	// changes.
+	if rpcErr := call(); rpcErr == nil || rpcErr.Code != ErrRPCMethodNotFound.Code {
+		t.Fatalf("call before Register: got error %v", rpcErr)
+	}
+
+	registry.Register("testdynamic", (*testDynamicCmd)(nil), func(s *RpcServer, cmd interface{}, closeChan <-chan struct{}) (interface{}, error) {
+		return "ok", nil
+	}, 0)
+	if changed := readNtfn(); len(changed.Added) != 1 ||
+		changed.Added[0] != "testdynamic" || len(changed.Removed) != 0 {
+
+		t.Errorf("Register: got notification %+v", changed)
+	}
+	if rpcErr := call(); rpcErr != nil {
+		t.Errorf("call after Register: unexpected error %v", rpcErr)
+	}
+
+	if err := registry.Unregister("testdynamic"); err != nil {
+		t.Fatalf("Unregister: unexpected error: %v", err)
+	}
+	if changed := readNtfn(); len(changed.Removed) != 1 ||
+		changed.Removed[0] != "testdynamic" || len(changed.Added) != 0 {
+
+		t.Errorf("Unregister: got notification %+v", changed)
+	}
+	if rpcErr := call(); rpcErr == nil || rpcErr.Code != ErrRPCMethodNotFound.Code {
+		t.Errorf("call after Unregister: got error %v", rpcErr)
+	}
+	if _, err := registry.CmdMethod((*testDynamicCmd)(nil)); err == nil {
+		t.Error("CmdMethod: command type was not unregistered")
+	}
+	if err := registry.Unregister("testdynamic"); err == nil {
+		t.Error("Unregister: expected error for unknown method")
+	}
+
+	// A command without a handler can not be called, so it is not
+	// announced.  A notification would be read in place of the reply.
+	if err := registry.RegisterCmd("testdynamic", (*testDynamicCmd)(nil), 0); err != nil {
+		t.Fatalf("RegisterCmd: unexpected error: %v", err)
+	}
+	if rpcErr := call(); rpcErr == nil || rpcErr.Code != ErrRPCMethodNotFound.Code {
+		t.Errorf("call after RegisterCmd: got error %v", rpcErr)
+	}
+
+	// Marking a registered command as unimplemented makes it callable, a
+	// handler added afterwards replaces the unimplemented one.
+	registry.AddUnimplemented("testdynamic")
+	if changed := readNtfn(); len(changed.Added) != 1 ||
+		changed.Added[0] != "testdynamic" || len(changed.Removed) != 0 {
+
+		t.Errorf("AddUnimplemented: got notification %+v", changed)
+	}
+	if rpcErr := call(); rpcErr == nil || rpcErr.Code != ErrRPCUnimplemented.Code {
+		t.Errorf("call after AddUnimplemented: got error %v", rpcErr)
+	}
+	registry.AddRpcHandler("testdynamic", func(s *RpcServer, cmd interface{}, closeChan <-chan struct{}) (interface{}, error) {
+		return "ok", nil
+	})
+	if rpcErr := call(); rpcErr != nil {
+		t.Errorf("call after AddRpcHandler: unexpected error %v", rpcErr)
+	}
+	if err := registry.Unregister("testdynamic"); err != nil {
+		t.Fatalf("Unregister: unexpected error: %v", err)
+	}
+	if changed := readNtfn(); len(changed.Removed) != 1 || len(changed.Added) != 0 {
+		t.Errorf("Unregister: got notification %+v", changed)
+	}
+
+	// Adding a handler for a method without one notifies the clients.
+	registry.AddRpcHandler("testdynamic", func(s *RpcServer, cmd interface{}, closeChan <-chan struct{}) (interface{}, error) {
+		return "ok", nil
+	})
+	if changed := readNtfn(); len(changed.Added) != 1 ||
+		changed.Added[0] != "testdynamic" || len(changed.Removed) != 0 {
+
+		t.Errorf("AddRpcHandler: got notification %+v", changed)
+	}
+	if err := registry.Unregister("testdynamic"); err != nil {
+		t.Fatalf("Unregister: unexpected error: %v", err)
+	}
+	readNtfn()
+
+	// Registering while requests are served must not race.
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 20; i++ {
+			registry.RegisterContext("testdynamic", (*testDynamicCmd)(nil), func(ctx context.Context, s *RpcServer, cmd interface{}) (interface{}, error) {
+				return "ok", nil
+			}, 0)
+			registry.Unregister("testdynamic")
+		}
+	}()
+	for i := 0; i < 20; i++ {
+		postJSON(t, addr, `{"jsonrpc":"2.0","method":"testdynamic","params":[],"id":1}`)
+	}
+	<-done
+}